@@ -0,0 +1,137 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+// batchKey returns key of batch location belongs to, locations with the same key differ only in coordinates.
+// Empty key means that location can't be batched.
+func (e *exporter) batchKey(loc types.Location) string {
+	if loc.Disabled || loc.Elevation != nil {
+		return ""
+	}
+	u, err := url.Parse(e.requestUri(loc))
+	if err != nil {
+		return ""
+	}
+	params := u.Query()
+	params.Del("latitude")
+	params.Del("longitude")
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// prefetchBatches fetches locations without fresh data in batches, so that subsequent scrape of every location
+// is served from cache. Locations of failed batch are left to be fetched individually.
+func (e *exporter) prefetchBatches(ctx context.Context) {
+	batches := map[string][]types.Location{}
+	var keys []string
+	for _, loc := range e.cfg().Locations {
+		key := e.batchKey(loc)
+		if key == "" {
+			continue
+		}
+		if entry, present := e.cached(loc); present && e.isFresh(loc, entry) {
+			continue
+		}
+		if _, ok := batches[key]; !ok {
+			keys = append(keys, key)
+		}
+		batches[key] = append(batches[key], loc)
+	}
+	for _, key := range keys {
+		if locs := batches[key]; len(locs) > 1 {
+			if err := e.batchFetch(ctx, locs); err != nil {
+				e.logger.Warn("Batch fetch failed, locations will be fetched individually",
+					"locations", len(locs), "error", err)
+			}
+		}
+	}
+}
+
+// batchFetch fetches data of multiple locations, which differ only in coordinates, in single request
+// and stores result of every location in cache. API returns results in the same order as coordinates.
+// Location is marked as prefetched, so that its next lookup updates status of location like fetch does.
+func (e *exporter) batchFetch(ctx context.Context, locs []types.Location) error {
+	u, err := url.Parse(e.requestUri(locs[0]))
+	if err != nil {
+		return err
+	}
+	lats := make([]string, len(locs))
+	lons := make([]string, len(locs))
+	names := make([]string, len(locs))
+	for i, loc := range locs {
+		params := locationParams(loc)
+		lats[i] = params.Get("latitude")
+		lons[i] = params.Get("longitude")
+		names[i] = loc.Name
+	}
+	params := u.Query()
+	params.Set("latitude", strings.Join(lats, ","))
+	params.Set("longitude", strings.Join(lons, ","))
+	u.RawQuery = params.Encode()
+
+	// batch may take as long as the most patient of its locations would wait for individual fetch
+	var timeout time.Duration
+	for _, loc := range locs {
+		timeout = max(timeout, e.fetchTimeout(loc))
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	e.logger.Debug("Fetching batch from API", "method", methodOf(locs[0]), "locations", len(locs))
+	start := time.Now()
+	data, _, err := e.get(ctx, u.String(), correlationId(strings.Join(names, ",")), nil)
+	duration := time.Since(start)
+	if err != nil {
+		return err
+	}
+	var batch types.BatchResponse
+	if err = json.Unmarshal(data, &batch); err != nil {
+		return err
+	}
+	if len(batch) != len(locs) {
+		return fmt.Errorf("batch response has %d results, expected %d", len(batch), len(locs))
+	}
+	now := time.Now()
+	for i, loc := range locs {
+		resp := newResponse(methodOf(loc))
+		if err = json.Unmarshal(batch[i], resp); err != nil {
+			return err
+		}
+		e.store(loc, types.CacheEntry{
+			Response:   resp,
+			LastUpdate: now,
+		})
+		e.statusLock.Lock()
+		st := e.locStatus(loc.Name)
+		st.prefetched = len(batch[i])
+		st.prefetchDuration = duration
+		e.statusLock.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+func TestBatchFetch(t *testing.T) {
+	result := strings.TrimSpace(currentWeatherJson)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		n := len(strings.Split(r.URL.Query().Get("latitude"), ","))
+		_, _ = io.WriteString(w, "["+strings.TrimSuffix(strings.Repeat(result+",", n), ",")+"]")
+	})
+	locs := []types.Location{
+		{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}},
+		{Name: "Kosice", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.72, Longitude: 21.26}},
+		{Name: "Vienna", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}},
+	}
+	e := newTestExporter(t, &types.Config{Batch: true, Locations: locs})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	// first scrape fetches all locations in single request, second one is served from cache
+	for i := 0; i < 2; i++ {
+		if _, err := reg.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := u.requests.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", got)
+	}
+	for _, loc := range locs {
+		if got := testutil.ToFloat64(e.up.WithLabelValues(loc.Name)); got != 1 {
+			t.Fatalf("expected %s to be up, got %v", loc.Name, got)
+		}
+		// batched fetch is accounted as miss of every location, just like individual fetch
+		if got := testutil.ToFloat64(e.cacheHitRatio.WithLabelValues(loc.Name)); got != 0.5 {
+			t.Fatalf("expected hit ratio 0.5 of %s, got %v", loc.Name, got)
+		}
+		if got := testutil.ToFloat64(e.lastResponseBytes.WithLabelValues(loc.Name)); got != float64(len(result)) {
+			t.Fatalf("expected last response of %s to be %d bytes, got %v", loc.Name, len(result), got)
+		}
+		if got := testutil.ToFloat64(e.lastSuccess.WithLabelValues(loc.Name)); got == 0 {
+			t.Fatalf("expected last success of %s to be set", loc.Name)
+		}
+		// fetch duration of every location is observed once for batch request and once for cache hit
+		for _, result := range []string{"miss", "hit"} {
+			if got := histogramCount(t, e.fetchDuration, loc.Name, result); got != 1 {
+				t.Fatalf("expected 1 %s of %s in fetch duration, got %d", result, loc.Name, got)
+			}
+		}
+	}
+}
+
+func TestBatchFetchHonorsLocationTimeout(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	})
+	locs := []types.Location{
+		{Name: "Bratislava", BaseURL: u.URL, TimeoutSeconds: 1, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}},
+		{Name: "Kosice", BaseURL: u.URL, TimeoutSeconds: 2, Coordinates: types.Coordinates{Latitude: 48.72, Longitude: 21.26}},
+	}
+	// global timeout alone would let batch request run for 5 seconds
+	e := NewExporter(&types.Config{Batch: true, Locations: locs}, time.Time{},
+		slog.New(slog.NewTextHandler(io.Discard, nil)), 5*time.Second).(*exporter)
+	t.Cleanup(e.Stop)
+
+	start := time.Now()
+	if err := e.batchFetch(context.Background(), locs); err == nil {
+		t.Fatal("expected batch fetch to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatalf("expected batch to be bound by the largest location timeout, took %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("expected batch request to be canceled")
+	}
+}
+
+// histogramCount returns number of observations of location's fetch duration with given result.
+func histogramCount(t *testing.T, hv *prometheus.HistogramVec, location, result string) uint64 {
+	var m dto.Metric
+	if err := hv.WithLabelValues(location, result).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
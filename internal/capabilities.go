@@ -0,0 +1,101 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+// CheckCapabilities verifies in background that API supports fetch methods of configured locations.
+// Verification is repeated after every reload.
+func (e *exporter) CheckCapabilities() {
+	e.reloadLock.Lock()
+	defer e.reloadLock.Unlock()
+	if e.stopped {
+		return
+	}
+	e.checkCapabilities = true
+	e.startCapabilitiesCheck(e.schedCtx)
+}
+
+// startCapabilitiesCheck probes capabilities in background until ctx is done, probe is tracked by schedWg.
+func (e *exporter) startCapabilitiesCheck(ctx context.Context) {
+	e.schedWg.Add(1)
+	go func() {
+		defer e.schedWg.Done()
+		e.probeCapabilities(ctx)
+	}()
+}
+
+// endpointOf returns request URI without query, which identifies API instance and its endpoint.
+func endpointOf(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// probeCapabilities issues single request for every combination of endpoint and fetch method in use and logs warning
+// for those which API rejects, for example self-hosted instance without air quality data.
+// Outcome is remembered, so that only combinations that weren't verified yet are probed after reload.
+func (e *exporter) probeCapabilities(ctx context.Context) {
+	probed := map[string]bool{}
+	for _, loc := range e.cfg().Locations {
+		uri := e.requestUri(loc)
+		key := endpointOf(uri) + " " + string(methodOf(loc))
+		if loc.Disabled || probed[key] {
+			continue
+		}
+		probed[key] = true
+		e.capabilitiesLock.Lock()
+		rejected, known := e.capabilities[key]
+		e.capabilitiesLock.Unlock()
+		if !known {
+			var err error
+			if rejected, err = e.probeMethod(ctx, loc, uri); err != nil {
+				e.locLogger(loc).Warn("Couldn't verify that API supports fetch method",
+					"method", methodOf(loc), "endpoint", endpointOf(uri), "error", err)
+				continue
+			}
+			e.capabilitiesLock.Lock()
+			e.capabilities[key] = rejected
+			e.capabilitiesLock.Unlock()
+		}
+		if rejected != nil {
+			e.locLogger(loc).Warn("API doesn't support fetch method, scrapes of locations using it will fail",
+				"method", methodOf(loc), "endpoint", endpointOf(uri), "status", rejected.StatusCode, "reason", rejected.Reason)
+		}
+	}
+}
+
+// probeMethod requests data of location and returns error of API, if it rejects request as invalid.
+// Other failures are returned as error, as they don't tell anything about capabilities of API.
+func (e *exporter) probeMethod(ctx context.Context, loc types.Location, uri string) (*statusError, error) {
+	_, _, err := e.getOnce(ctx, uri, correlationId(loc.Name), nil)
+	var se *statusError
+	if errors.As(err, &se) && (se.StatusCode == http.StatusBadRequest || se.StatusCode == http.StatusNotFound) {
+		return se, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+func TestProbeCapabilities(t *testing.T) {
+	// self-hosted instance without air quality data rejects its parameters
+	selfHosted := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/air-quality" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `{"error": true, "reason": "Cannot initialize CurrentVariable from invalid String value european_aqi"}`)
+			return
+		}
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	broken := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	airQuality := types.FetchMethod(types.FetchMethodAirQuality)
+	e := newTestExporter(t, &types.Config{BaseURL: selfHosted.URL + "/v1/forecast", Locations: []types.Location{
+		{Name: "Bratislava", Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}},
+		{Name: "Vienna", FetchMethod: &airQuality, Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}},
+		{Name: "Budapest", FetchMethod: &airQuality, Coordinates: types.Coordinates{Latitude: 47.5, Longitude: 19.04}},
+		{Name: "Prague", FetchMethod: &airQuality, BaseURL: broken.URL + "/v1/forecast", Coordinates: types.Coordinates{Latitude: 50.08, Longitude: 14.44}},
+	}})
+	var out bytes.Buffer
+	e.logger = slog.New(slog.NewTextHandler(&out, nil))
+
+	e.probeCapabilities(context.Background())
+
+	// every combination of endpoint and method is probed once
+	if got := selfHosted.requests.Load(); got != 2 {
+		t.Errorf("expected 2 requests to self-hosted instance, got %d", got)
+	}
+	if got := broken.requests.Load(); got != 1 {
+		t.Errorf("expected 1 request to broken instance, got %d", got)
+	}
+	logs := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 warnings, got:\n%s", out.String())
+	}
+	for _, s := range []string{`msg="API doesn't support fetch method`, "location=Vienna", "method=air_quality", "status=400",
+		"endpoint=" + selfHosted.URL + "/v1/air-quality", `reason="Cannot initialize`} {
+		if !strings.Contains(logs[0], s) {
+			t.Errorf("expected warning about unsupported method to contain %q, got: %s", s, logs[0])
+		}
+	}
+	for _, s := range []string{`msg="Couldn't verify that API supports fetch method"`, "location=Prague",
+		"endpoint=" + broken.URL + "/v1/air-quality"} {
+		if !strings.Contains(logs[1], s) {
+			t.Errorf("expected warning about failed verification to contain %q, got: %s", s, logs[1])
+		}
+	}
+	host, _ := url.Parse(selfHosted.URL)
+	if got := testutil.ToFloat64(e.httpResponses.WithLabelValues(host.Host, "400")); got != 1 {
+		t.Errorf("expected probe response to be counted, got %v", got)
+	}
+}
+
+func TestApiUriFollowsBaseUrl(t *testing.T) {
+	airQuality := types.FetchMethod(types.FetchMethodAirQuality)
+	public := types.Location{Name: "Bratislava", FetchMethod: &airQuality}
+	selfHosted := types.Location{Name: "Vienna", FetchMethod: &airQuality, BaseURL: "http://open-meteo:8080/v1/forecast"}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{public, selfHosted}})
+
+	if got := endpointOf(e.requestUri(public)); got != airQualityUri {
+		t.Errorf("expected public endpoint %s, got %s", airQualityUri, got)
+	}
+	if got := endpointOf(e.requestUri(selfHosted)); got != "http://open-meteo:8080/v1/air-quality" {
+		t.Errorf("expected endpoint next to forecast one of self-hosted instance, got %s", got)
+	}
+}
+
+func TestCheckCapabilitiesOnReloadProbesOnlyNewEndpoints(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	other := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	cfg := &types.Config{Locations: []types.Location{loc}}
+	e := newTestExporter(t, cfg)
+
+	e.CheckCapabilities()
+	waitFor(t, "capabilities check", func() bool {
+		return u.requests.Load() == 1
+	})
+	// endpoint of location added by reload is probed, already verified one isn't
+	if err := e.Reload(&types.Config{Locations: []types.Location{loc,
+		{Name: "Vienna", BaseURL: other.URL, Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}},
+	}}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "capabilities check after reload", func() bool {
+		return other.requests.Load() == 1
+	})
+	if err := e.Reload(cfg, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	e.Stop()
+	if got := u.requests.Load(); got != 1 {
+		t.Fatalf("expected verified endpoint not to be probed again, got %d requests", got)
+	}
+
+	stopped := newTestExporter(t, cfg)
+	stopped.Stop()
+	stopped.CheckCapabilities()
+	if got := u.requests.Load(); got != 1 {
+		t.Fatalf("expected no capabilities check after stop, got %d requests", got)
+	}
+}
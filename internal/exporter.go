@@ -18,11 +18,24 @@
 package internal
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rkosegi/open-meteo-exporter/types"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -31,32 +44,238 @@ const (
 	subsystem = "exporter"
 	namespace = "openmeteo"
 	baseUri   = "https://api.open-meteo.com/v1/forecast"
+	// airQualityUri is endpoint of air quality API
+	airQualityUri = "https://air-quality-api.open-meteo.com/v1/air-quality"
+	// marineUri is endpoint of marine weather API
+	marineUri = "https://marine-api.open-meteo.com/v1/marine"
+	// floodUri is endpoint of flood API
+	floodUri = "https://flood-api.open-meteo.com/v1/flood"
+	// defaultMaxConcurrency is number of locations scraped concurrently unless configured otherwise
+	defaultMaxConcurrency = 4
+	// defaultHttpTimeout is timeout of requests to API unless configured otherwise
+	defaultHttpTimeout = 30 * time.Second
+	// maxProbeCacheEntries bounds number of responses cached for probes
+	maxProbeCacheEntries = 1000
 )
 
+// Exporter is prometheus.Collector which may run background activities.
+type Exporter interface {
+	prometheus.Collector
+	// Stop terminates all background activities and waits for them to finish.
+	// Calling it more than once has no effect.
+	Stop()
+	// WeatherHandler returns handler that serves latest readings of location as JSON.
+	WeatherHandler() http.Handler
+	// WithContext returns collector that scrapes locations using given context,
+	// so that scrape can be bound to deadline of incoming request.
+	WithContext(ctx context.Context) prometheus.Collector
+	// Reload replaces configuration of running exporter, it fails once exporter is stopped.
+	// Modification time of config file is exported, unless it's zero.
+	Reload(config *types.Config, configMtime time.Time) error
+	// ProbeHandler returns handler that serves metrics of single location given by query parameters.
+	ProbeHandler() http.Handler
+	// ConfigHandler returns handler that serves active configuration with secrets redacted.
+	ConfigHandler() http.Handler
+	// TargetsHandler returns handler that serves status of all locations as JSON.
+	TargetsHandler() http.Handler
+	// Start starts scheduled and background refreshes of locations and pushes of their data, as configured.
+	// Exporter which isn't started only fetches data when scraped, which is what single gather needs.
+	Start()
+	// CheckCapabilities verifies in background that API supports fetch methods of configured locations.
+	CheckCapabilities()
+}
+
+// locationStatus tracks outcome of recent operations for single location.
+type locationStatus struct {
+	// number of consecutive fetch failures
+	failures    int
+	cacheHits   int
+	cacheMisses int
+	// whether location was already fetched at least once
+	attempted bool
+	// size of response fetched by batch, which wasn't looked up by scrape yet, zero if there is none
+	prefetched int
+	// duration of batch request which fetched the prefetched response
+	prefetchDuration time.Duration
+	// most recent fetch error and time when it occurred
+	lastError     string
+	lastErrorTime time.Time
+}
+
 type exporter struct {
 	logger       *slog.Logger
-	scrapeErrors prometheus.Counter
-	totalScrapes prometheus.Counter
-
-	tempDesc            *prometheus.GaugeVec
-	tempApparentDesc    *prometheus.GaugeVec
-	relHumidityDesc     *prometheus.GaugeVec
-	precipitationDesc   *prometheus.GaugeVec
-	rainDesc            *prometheus.GaugeVec
-	showersDesc         *prometheus.GaugeVec
-	snowfallDesc        *prometheus.GaugeVec
-	cloudCoverDesc      *prometheus.GaugeVec
-	surfacePressureDesc *prometheus.GaugeVec
-	pressureMslDesc     *prometheus.GaugeVec
-	windSpeedDesc       *prometheus.GaugeVec
-	windDirDesc         *prometheus.GaugeVec
-	windGustsDesc       *prometheus.GaugeVec
-	cacheHit            *prometheus.CounterVec
-	httpFetchDuration   prometheus.Summary
-	httpTraffic         prometheus.Counter
-	config              *types.Config
-	client              http.Client
-	cache               map[string]types.CacheEntry
+	scrapeErrors *prometheus.CounterVec
+	rateLimited  prometheus.Counter
+	influxErrors prometheus.Counter
+	notModified  prometheus.Counter
+	otlpErrors   prometheus.Counter
+	// otlp pushes weather metrics every interval, nil when not configured
+	otlp *otlpmetricgrpc.Exporter
+	// weatherRegistry holds weather gauges of all locations, it's gathered for every push to OTLP receiver
+	weatherRegistry *prometheus.Registry
+	totalScrapes    prometheus.Counter
+	metricFamilies  prometheus.Gauge
+	// staticLabels are sorted keys of static labels of all locations, which are appended to labels of location's metrics
+	staticLabels   []string
+	staleEntries   prometheus.Gauge
+	cacheEntries   prometheus.Gauge
+	cacheAge       *prometheus.GaugeVec
+	concurrency    prometheus.Gauge
+	requestTimeout prometheus.Gauge
+	// locationTimeout is timeout of fetch of locations which set their own
+	locationTimeout *prometheus.GaugeVec
+	httpTimeout     time.Duration
+	// clock drives schedules of locations
+	clock clock
+	// number of locations which failed their first fetch
+	initialFailures prometheus.Gauge
+	// modification time of loaded config file
+	configMtime prometheus.Gauge
+
+	tempDesc                 *prometheus.GaugeVec
+	tempApparentDesc         *prometheus.GaugeVec
+	relHumidityDesc          *prometheus.GaugeVec
+	precipitationDesc        *prometheus.GaugeVec
+	rainDesc                 *prometheus.GaugeVec
+	showersDesc              *prometheus.GaugeVec
+	snowfallDesc             *prometheus.GaugeVec
+	cloudCoverDesc           *prometheus.GaugeVec
+	surfacePressureDesc      *prometheus.GaugeVec
+	pressureMslDesc          *prometheus.GaugeVec
+	windSpeedDesc            *prometheus.GaugeVec
+	windDirDesc              *prometheus.GaugeVec
+	windGustsDesc            *prometheus.GaugeVec
+	windGustFactorDesc       *prometheus.GaugeVec
+	uvIndexDesc              *prometheus.GaugeVec
+	visibilityDesc           *prometheus.GaugeVec
+	dewPointDesc             *prometheus.GaugeVec
+	isDayDesc                *prometheus.GaugeVec
+	weatherCodeDesc          *prometheus.GaugeVec
+	weatherCodeInfoDesc      *prometheus.GaugeVec
+	observationAgeDesc       *prometheus.GaugeVec
+	cloudCoverLowDesc        *prometheus.GaugeVec
+	cloudCoverMidDesc        *prometheus.GaugeVec
+	cloudCoverHighDesc       *prometheus.GaugeVec
+	soilTemperatureDesc      *prometheus.GaugeVec
+	soilMoistureDesc         *prometheus.GaugeVec
+	evapotranspirationDesc   *prometheus.GaugeVec
+	vaporPressureDeficitDesc *prometheus.GaugeVec
+	dailyTempMaxDesc         *prometheus.GaugeVec
+	dailyTempMinDesc         *prometheus.GaugeVec
+	hourlyTempDesc           *prometheus.GaugeVec
+	hourlyPrecipProbDesc     *prometheus.GaugeVec
+	europeanAqiDesc          *prometheus.GaugeVec
+	usAqiDesc                *prometheus.GaugeVec
+	waveHeightDesc           *prometheus.GaugeVec
+	waveDirectionDesc        *prometheus.GaugeVec
+	wavePeriodDesc           *prometheus.GaugeVec
+	swellWaveHeightDesc      *prometheus.GaugeVec
+	swellWavePeriodDesc      *prometheus.GaugeVec
+	riverDischargeDesc       *prometheus.GaugeVec
+	lastResponseBytes        *prometheus.GaugeVec
+	generationTime           *prometheus.GaugeVec
+	elevationDesc            *prometheus.GaugeVec
+	utcOffsetDesc            *prometheus.GaugeVec
+	timezoneDesc             *prometheus.GaugeVec
+	cacheHit                 *prometheus.CounterVec
+	cacheMiss                *prometheus.CounterVec
+	cacheHitRatio            *prometheus.GaugeVec
+	up                       *prometheus.GaugeVec
+	lastSuccess              *prometheus.GaugeVec
+	status                   map[string]*locationStatus
+	statusLock               sync.Mutex
+	implausibleValues        *prometheus.CounterVec
+	apiErrors                *prometheus.CounterVec
+	httpFetchDuration        prometheus.Summary
+	fetchDuration            *prometheus.HistogramVec
+	httpDuration             *prometheus.HistogramVec
+	httpResponses            *prometheus.CounterVec
+	httpTraffic              prometheus.Counter
+	// config is swapped on reload, use cfg to access it
+	config atomic.Pointer[types.Config]
+	client http.Client
+	// transport of client, it's rebuilt on reload
+	transport *reloadableTransport
+	// root is exporter owning state shared with probes (cache and rate limiting backoff), itself unless e is probe
+	root *exporter
+	// backoffUntil maps API host to time until which requests to it are suspended due to rate limiting
+	backoffUntil map[string]time.Time
+	backoffLock  sync.Mutex
+	cache        map[string]types.CacheEntry
+	// probeCache holds responses fetched by probes, so that arbitrary targets don't grow cache of configured locations
+	probeCache map[string]types.CacheEntry
+	// cacheLock guards cache and probeCache, use cached and store rather than accessing them directly
+	cacheLock sync.RWMutex
+	// limiter limits rate of requests to API
+	limiter atomic.Pointer[rate.Limiter]
+	// flight collapses concurrent fetches of the same cache key
+	flight singleflight.Group
+	ctx    context.Context
+	cancel context.CancelFunc
+	// schedCtx is context of scheduled and background refreshes and of capabilities check, which are tracked
+	// by schedWg and stopped by schedCancel
+	schedCtx    context.Context
+	schedCancel context.CancelFunc
+	schedWg     sync.WaitGroup
+	// reloadLock serializes reloads and stop, stopped, started and checkCapabilities are guarded by it
+	reloadLock sync.Mutex
+	stopped    bool
+	// started is set once background activities are requested, so that they are restarted on reload
+	started bool
+	// checkCapabilities is set once capabilities check is requested, so that it's repeated on reload
+	checkCapabilities bool
+	// capabilities holds outcome of probes by endpoint and fetch method, nil error means method is supported
+	capabilities     map[string]*statusError
+	capabilitiesLock sync.Mutex
+}
+
+// weatherGauges returns all gauges that hold data received from API.
+func (e *exporter) weatherGauges() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		e.tempDesc,
+		e.tempApparentDesc,
+		e.relHumidityDesc,
+		e.precipitationDesc,
+		e.rainDesc,
+		e.showersDesc,
+		e.snowfallDesc,
+		e.cloudCoverDesc,
+		e.surfacePressureDesc,
+		e.pressureMslDesc,
+		e.windSpeedDesc,
+		e.windDirDesc,
+		e.windGustsDesc,
+		e.windGustFactorDesc,
+		e.uvIndexDesc,
+		e.visibilityDesc,
+		e.dewPointDesc,
+		e.isDayDesc,
+		e.weatherCodeDesc,
+		e.weatherCodeInfoDesc,
+		e.observationAgeDesc,
+		e.cloudCoverLowDesc,
+		e.cloudCoverMidDesc,
+		e.cloudCoverHighDesc,
+		e.soilTemperatureDesc,
+		e.soilMoistureDesc,
+		e.evapotranspirationDesc,
+		e.vaporPressureDeficitDesc,
+		e.dailyTempMaxDesc,
+		e.dailyTempMinDesc,
+		e.hourlyTempDesc,
+		e.hourlyPrecipProbDesc,
+		e.europeanAqiDesc,
+		e.usAqiDesc,
+		e.waveHeightDesc,
+		e.waveDirectionDesc,
+		e.wavePeriodDesc,
+		e.swellWaveHeightDesc,
+		e.swellWavePeriodDesc,
+		e.riverDischargeDesc,
+		e.elevationDesc,
+		e.utcOffsetDesc,
+		e.timezoneDesc,
+	}
 }
 
 func (e *exporter) Describe(ch chan<- *prometheus.Desc) {
@@ -73,40 +292,253 @@ func (e *exporter) Describe(ch chan<- *prometheus.Desc) {
 	e.windSpeedDesc.Describe(ch)
 	e.windDirDesc.Describe(ch)
 	e.windGustsDesc.Describe(ch)
+	e.windGustFactorDesc.Describe(ch)
+	e.uvIndexDesc.Describe(ch)
+	e.visibilityDesc.Describe(ch)
+	e.dewPointDesc.Describe(ch)
+	e.isDayDesc.Describe(ch)
+	e.weatherCodeDesc.Describe(ch)
+	e.weatherCodeInfoDesc.Describe(ch)
+	e.observationAgeDesc.Describe(ch)
+	e.cloudCoverLowDesc.Describe(ch)
+	e.cloudCoverMidDesc.Describe(ch)
+	e.cloudCoverHighDesc.Describe(ch)
+	e.soilTemperatureDesc.Describe(ch)
+	e.soilMoistureDesc.Describe(ch)
+	e.evapotranspirationDesc.Describe(ch)
+	e.vaporPressureDeficitDesc.Describe(ch)
+	e.dailyTempMaxDesc.Describe(ch)
+	e.dailyTempMinDesc.Describe(ch)
+	e.hourlyTempDesc.Describe(ch)
+	e.hourlyPrecipProbDesc.Describe(ch)
+	e.europeanAqiDesc.Describe(ch)
+	e.usAqiDesc.Describe(ch)
+	e.waveHeightDesc.Describe(ch)
+	e.waveDirectionDesc.Describe(ch)
+	e.wavePeriodDesc.Describe(ch)
+	e.swellWaveHeightDesc.Describe(ch)
+	e.swellWavePeriodDesc.Describe(ch)
+	e.riverDischargeDesc.Describe(ch)
+	e.lastResponseBytes.Describe(ch)
+	e.generationTime.Describe(ch)
+	e.elevationDesc.Describe(ch)
+	e.utcOffsetDesc.Describe(ch)
+	e.timezoneDesc.Describe(ch)
 
 	e.httpFetchDuration.Describe(ch)
+	e.fetchDuration.Describe(ch)
+	e.httpDuration.Describe(ch)
+	e.httpResponses.Describe(ch)
 	e.httpTraffic.Describe(ch)
 	e.cacheHit.Describe(ch)
+	e.cacheMiss.Describe(ch)
+	e.cacheHitRatio.Describe(ch)
+	e.up.Describe(ch)
+	e.lastSuccess.Describe(ch)
+	e.implausibleValues.Describe(ch)
 	e.totalScrapes.Describe(ch)
 	e.scrapeErrors.Describe(ch)
+	e.rateLimited.Describe(ch)
+	e.influxErrors.Describe(ch)
+	e.notModified.Describe(ch)
+	e.otlpErrors.Describe(ch)
+	e.apiErrors.Describe(ch)
+	e.metricFamilies.Describe(ch)
+	e.staleEntries.Describe(ch)
+	e.cacheEntries.Describe(ch)
+	e.cacheAge.Describe(ch)
+	e.concurrency.Describe(ch)
+	e.requestTimeout.Describe(ch)
+	e.locationTimeout.Describe(ch)
+	e.initialFailures.Describe(ch)
+	e.configMtime.Describe(ch)
+}
+
+// boundCollector is exporter that scrapes using context other than the one of exporter itself.
+type boundCollector struct {
+	*exporter
+	ctx context.Context
+}
+
+func (b *boundCollector) Collect(ch chan<- prometheus.Metric) {
+	b.collect(b.ctx, ch)
+}
+
+func (e *exporter) WithContext(ctx context.Context) prometheus.Collector {
+	return &boundCollector{exporter: e, ctx: ctx}
 }
 
 func (e *exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collect(e.ctx, ch)
+}
+
+func (e *exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
 	e.totalScrapes.Inc()
-	e.scrape(ch)
+	e.scrape(ctx, ch)
 	e.totalScrapes.Collect(ch)
 	e.scrapeErrors.Collect(ch)
+	e.rateLimited.Collect(ch)
+	e.influxErrors.Collect(ch)
+	e.notModified.Collect(ch)
+	e.otlpErrors.Collect(ch)
+	e.apiErrors.Collect(ch)
+	e.metricFamilies.Collect(ch)
+	e.concurrency.Collect(ch)
+	e.requestTimeout.Collect(ch)
+	e.locationTimeout.Collect(ch)
+	e.initialFailures.Collect(ch)
+	e.configMtime.Collect(ch)
 }
 
-func (e *exporter) onError(err error) {
-	e.logger.Error("Error while fetching data", "error", err)
-	e.scrapeErrors.Inc()
+// countMetricFamilies returns number of distinct metric descriptors produced by Describe.
+func (e *exporter) countMetricFamilies() int {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		e.Describe(ch)
+		close(ch)
+	}()
+	descs := map[string]bool{}
+	for desc := range ch {
+		descs[desc.String()] = true
+	}
+	return len(descs)
 }
 
-func (e *exporter) scrapeTarget(target types.Location, ch chan<- prometheus.Metric) {
-	if target.FetchMethod == nil || *target.FetchMethod == types.FetchMethodDefault {
-		e.handleDefault(target, ch)
-	} else if *target.FetchMethod == types.FetchMethodAlt {
-		e.handleAlt(target, ch)
+// onError logs error of location and counts it under given type, which is one of errorType* constants.
+func (e *exporter) onError(loc types.Location, errType string, err error) {
+	e.locLogger(loc).Error("Error while fetching data", "type", errType, "error", err)
+	e.scrapeErrors.WithLabelValues(loc.Name, errType).Inc()
+}
+
+func (e *exporter) scrapeTarget(ctx context.Context, target types.Location) {
+	switch methodOf(target) {
+	case types.FetchMethodDefault:
+		e.handleDefault(ctx, target)
+	case types.FetchMethodAlt:
+		e.handleAlt(ctx, target)
+	case types.FetchMethodDaily:
+		e.handleDaily(ctx, target)
+	case types.FetchMethodHourly:
+		e.handleHourly(ctx, target)
+	case types.FetchMethodAirQuality:
+		e.handleAirQuality(ctx, target)
+	case types.FetchMethodMarine:
+		e.handleMarine(ctx, target)
+	case types.FetchMethodFlood:
+		e.handleFlood(ctx, target)
+	}
+}
+
+// maxConcurrency returns number of locations that are scraped concurrently, defaults to 4.
+func (e *exporter) maxConcurrency() int {
+	if e.cfg().MaxConcurrency > 0 {
+		return e.cfg().MaxConcurrency
+	}
+	return defaultMaxConcurrency
+}
+
+// locStatus returns status of location, caller must hold statusLock.
+func (e *exporter) locStatus(name string) *locationStatus {
+	st, ok := e.status[name]
+	if !ok {
+		st = &locationStatus{}
+		e.status[name] = st
 	}
+	return st
+}
+
+func (e *exporter) updateCacheHitRatio() {
+	e.statusLock.Lock()
+	defer e.statusLock.Unlock()
+	for _, loc := range e.cfg().Locations {
+		st, ok := e.status[loc.Name]
+		if !ok {
+			continue
+		}
+		if lookups := st.cacheHits + st.cacheMisses; lookups > 0 {
+			e.cacheHitRatio.WithLabelValues(e.locationLabelValues(loc)...).Set(float64(st.cacheHits) / float64(lookups))
+		}
+	}
+}
 
+// countStaleEntries returns number of cache entries that are no longer fresh and would be fetched again.
+func (e *exporter) countStaleEntries() int {
+	stale := 0
+	for _, loc := range e.cfg().Locations {
+		if entry, present := e.cached(loc); present && !e.isFresh(loc, entry) {
+			stale++
+		}
+	}
+	return stale
+}
+
+// updateCacheStats updates number of cache entries and age of cached data of every location.
+func (e *exporter) updateCacheStats() {
+	e.root.cacheLock.RLock()
+	e.cacheEntries.Set(float64(len(e.root.cache)))
+	e.root.cacheLock.RUnlock()
+	for _, loc := range e.cfg().Locations {
+		if entry, present := e.cached(loc); present {
+			e.cacheAge.WithLabelValues(e.locationLabelValues(loc)...).Set(time.Since(entry.LastUpdate).Seconds())
+		}
+	}
 }
 
-func (e *exporter) scrape(ch chan<- prometheus.Metric) {
+// withStaticLabels appends keys of static labels of locations to label names of location's metric.
+func (e *exporter) withStaticLabels(names ...string) []string {
+	return append(names, e.staticLabels...)
+}
+
+// staticLabelValues returns values of static labels of location, in order of their keys.
+// Keys not declared by location have empty value.
+func (e *exporter) staticLabelValues(loc types.Location) []string {
+	lvs := make([]string, len(e.staticLabels))
+	for i, key := range e.staticLabels {
+		lvs[i] = loc.Labels[key]
+	}
+	return lvs
+}
+
+// locationLabelValues returns label values of location's metric that has no other labels than location.
+func (e *exporter) locationLabelValues(loc types.Location) []string {
+	return append([]string{loc.Name}, e.staticLabelValues(loc)...)
+}
+
+func (e *exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) {
 	start := time.Now().UnixMilli()
-	for _, target := range e.config.Locations {
-		e.scrapeTarget(target, ch)
+	e.staleEntries.Set(float64(e.countStaleEntries()))
+	e.staleEntries.Collect(ch)
+	if e.cfg().Batch {
+		e.prefetchBatches(ctx)
+	}
+	sem := make(chan struct{}, e.maxConcurrency())
+	var wg sync.WaitGroup
+	for _, target := range e.cfg().Locations {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(target types.Location) {
+			// panic is counted as error, so that it can't take down scrape of other locations
+			defer func() {
+				if r := recover(); r != nil {
+					e.onError(target, errorTypeOther, fmt.Errorf("panic while scraping location %s: %v", target.Name, r))
+				}
+				<-sem
+				wg.Done()
+			}()
+			if !target.Disabled {
+				e.scrapeTarget(ctx, target)
+			}
+			// series which disappear from scrape are marked stale by Prometheus itself,
+			// explicit stale marker wouldn't survive text exposition format
+			e.dropStaleSeries(target)
+		}(target)
 	}
+	wg.Wait()
+	e.updateCacheStats()
+	e.up.Collect(ch)
+	e.lastSuccess.Collect(ch)
+	e.cacheEntries.Collect(ch)
+	e.cacheAge.Collect(ch)
 	e.tempDesc.Collect(ch)
 	e.tempApparentDesc.Collect(ch)
 	e.relHumidityDesc.Collect(ch)
@@ -120,103 +552,362 @@ func (e *exporter) scrape(ch chan<- prometheus.Metric) {
 	e.windSpeedDesc.Collect(ch)
 	e.windDirDesc.Collect(ch)
 	e.windGustsDesc.Collect(ch)
+	e.windGustFactorDesc.Collect(ch)
+	e.uvIndexDesc.Collect(ch)
+	e.visibilityDesc.Collect(ch)
+	e.dewPointDesc.Collect(ch)
+	e.isDayDesc.Collect(ch)
+	e.weatherCodeDesc.Collect(ch)
+	e.weatherCodeInfoDesc.Collect(ch)
+	e.observationAgeDesc.Collect(ch)
+	e.cloudCoverLowDesc.Collect(ch)
+	e.cloudCoverMidDesc.Collect(ch)
+	e.cloudCoverHighDesc.Collect(ch)
+	e.soilTemperatureDesc.Collect(ch)
+	e.soilMoistureDesc.Collect(ch)
+	e.evapotranspirationDesc.Collect(ch)
+	e.vaporPressureDeficitDesc.Collect(ch)
+	e.dailyTempMaxDesc.Collect(ch)
+	e.dailyTempMinDesc.Collect(ch)
+	e.hourlyTempDesc.Collect(ch)
+	e.hourlyPrecipProbDesc.Collect(ch)
+	e.europeanAqiDesc.Collect(ch)
+	e.usAqiDesc.Collect(ch)
+	e.waveHeightDesc.Collect(ch)
+	e.waveDirectionDesc.Collect(ch)
+	e.wavePeriodDesc.Collect(ch)
+	e.swellWaveHeightDesc.Collect(ch)
+	e.swellWavePeriodDesc.Collect(ch)
+	e.riverDischargeDesc.Collect(ch)
+	e.lastResponseBytes.Collect(ch)
+	e.generationTime.Collect(ch)
+	e.elevationDesc.Collect(ch)
+	e.utcOffsetDesc.Collect(ch)
+	e.timezoneDesc.Collect(ch)
+	e.cacheHit.Collect(ch)
+	e.cacheMiss.Collect(ch)
+	e.updateCacheHitRatio()
+	e.cacheHitRatio.Collect(ch)
+	e.implausibleValues.Collect(ch)
 
 	e.httpFetchDuration.Observe(float64(time.Now().UnixMilli() - start))
 	e.httpFetchDuration.Collect(ch)
+	e.fetchDuration.Collect(ch)
+	e.httpDuration.Collect(ch)
+	e.httpResponses.Collect(ch)
 	e.httpTraffic.Collect(ch)
 }
 
+// init creates metrics of exporter.
 func (e *exporter) init() {
+	e.staticLabels = e.cfg().LabelKeys()
 	e.tempDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "temperature",
 		Help:      "The current temperature.",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "unit", "model", "latitude", "longitude"))
 
 	e.tempApparentDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "apparent_temperature",
 		Help:      "The apparent temperature.",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "unit", "model", "latitude", "longitude"))
 
 	e.relHumidityDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "relative_humidity",
 		Help:      "The relative humidity.",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
 
 	e.precipitationDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "precipitation",
 		Help:      "Probability of precipitation.",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "unit", "model", "latitude", "longitude"))
 
 	e.rainDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "rain",
 		Help:      "Rain from large scale weather systems",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "unit", "model", "latitude", "longitude"))
 
 	e.showersDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "showers",
 		Help:      "Showers from convective precipitation",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "unit", "model", "latitude", "longitude"))
 
 	e.snowfallDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "snowfall",
 		Help:      "The snowfall.",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "unit", "model", "latitude", "longitude"))
 
 	e.cloudCoverDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "cloud_cover",
 		Help:      "Total cloud cover as an area fraction.",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
 
 	e.surfacePressureDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "surface_pressure",
 		Help:      "Atmospheric air pressure at surface",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
 
 	e.pressureMslDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "pressure_msl",
 		Help:      "Atmospheric air pressure reduced to mean sea level",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
 
 	e.windSpeedDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "wind_speed",
-		Help:      "The current wind speed.",
-	}, []string{"location"})
+		Help:      "The current wind speed at given height above ground.",
+	}, e.withStaticLabels("location", "height", "unit", "model", "latitude", "longitude"))
 
 	e.windDirDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "wind_dir",
-		Help:      "The current wind direction.",
-	}, []string{"location"})
+		Help:      "The current wind direction at given height above ground.",
+	}, e.withStaticLabels("location", "height", "model", "latitude", "longitude"))
 
 	e.windGustsDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "current",
 		Name:      "wind_gusts",
 		Help:      "Wind gusts at 10 meters above ground",
-	}, []string{"location"})
+	}, e.withStaticLabels("location", "unit", "model", "latitude", "longitude"))
+
+	e.windGustFactorDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "wind_gust_factor",
+		Help:      "Ratio of wind gusts to wind speed at 10 meters above ground.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.uvIndexDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "uv_index",
+		Help:      "The UV index at the location.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.visibilityDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "visibility",
+		Help:      "The visibility in meters.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.dewPointDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "dew_point",
+		Help:      "The dew point temperature at 2 meters above ground.",
+	}, e.withStaticLabels("location", "unit", "model", "latitude", "longitude"))
+
+	e.isDayDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "is_day",
+		Help:      "Whether it is day (1) or night (0) at the location.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.weatherCodeDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "weather_code",
+		Help:      "The weather condition as WMO code.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.weatherCodeInfoDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "weather_code_info",
+		Help:      "Textual description of the current WMO weather code, value is always 1.",
+	}, e.withStaticLabels("location", "description", "model", "latitude", "longitude"))
+
+	e.observationAgeDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "observation_age_seconds",
+		Help:      "Age of the current observation, as reported by API.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.cloudCoverLowDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "cloud_cover_low",
+		Help:      "Low level clouds and fog up to 3 km altitude as an area fraction.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.cloudCoverMidDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "cloud_cover_mid",
+		Help:      "Mid level clouds from 3 to 8 km altitude as an area fraction.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.cloudCoverHighDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "cloud_cover_high",
+		Help:      "High level clouds from 8 km altitude as an area fraction.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.soilTemperatureDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "soil_temperature",
+		Help:      "Soil temperature at given depth below ground.",
+	}, e.withStaticLabels("location", "depth", "unit", "model", "latitude", "longitude"))
+
+	e.soilMoistureDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "soil_moisture",
+		Help:      "Average soil water content as volumetric mixing ratio in given layer below ground.",
+	}, e.withStaticLabels("location", "layer", "model", "latitude", "longitude"))
+
+	e.evapotranspirationDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "evapotranspiration",
+		Help:      "ET0 reference evapotranspiration of a well watered grass field.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.vaporPressureDeficitDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "current",
+		Name:      "vapor_pressure_deficit",
+		Help:      "Vapor pressure deficit in kPa.",
+	}, e.withStaticLabels("location", "model", "latitude", "longitude"))
+
+	e.dailyTempMaxDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "daily",
+		Name:      "temperature_max",
+		Help:      "Forecast of maximum daily temperature at 2 meters above ground, day is offset from today.",
+	}, e.withStaticLabels("location", "day", "unit"))
+
+	e.dailyTempMinDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "daily",
+		Name:      "temperature_min",
+		Help:      "Forecast of minimum daily temperature at 2 meters above ground, day is offset from today.",
+	}, e.withStaticLabels("location", "day", "unit"))
+
+	e.hourlyTempDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "hourly",
+		Name:      "temperature",
+		Help:      "Hourly forecast of temperature at 2 meters above ground, hour is offset from current hour.",
+	}, e.withStaticLabels("location", "hour", "unit"))
+
+	e.hourlyPrecipProbDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "hourly",
+		Name:      "precipitation_probability",
+		Help:      "Hourly forecast of probability of precipitation, hour is offset from current hour.",
+	}, e.withStaticLabels("location", "hour"))
+
+	e.europeanAqiDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "air_quality",
+		Name:      "european_aqi",
+		Help:      "European air quality index.",
+	}, e.withStaticLabels("location"))
+
+	e.usAqiDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "air_quality",
+		Name:      "us_aqi",
+		Help:      "United States air quality index.",
+	}, e.withStaticLabels("location"))
+
+	e.waveHeightDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "marine",
+		Name:      "wave_height",
+		Help:      "Mean height of significant waves.",
+	}, e.withStaticLabels("location"))
+
+	e.waveDirectionDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "marine",
+		Name:      "wave_direction",
+		Help:      "Mean direction of waves.",
+	}, e.withStaticLabels("location"))
+
+	e.wavePeriodDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "marine",
+		Name:      "wave_period",
+		Help:      "Mean period of waves.",
+	}, e.withStaticLabels("location"))
+
+	e.swellWaveHeightDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "marine",
+		Name:      "swell_wave_height",
+		Help:      "Mean height of swell waves.",
+	}, e.withStaticLabels("location"))
+
+	e.swellWavePeriodDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "marine",
+		Name:      "swell_wave_period",
+		Help:      "Mean period of swell waves.",
+	}, e.withStaticLabels("location"))
+
+	e.riverDischargeDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "flood",
+		Name:      "river_discharge",
+		Help:      "Daily river discharge rate in m³/s, day is offset from today.",
+	}, e.withStaticLabels("location", "day"))
+
+	e.lastResponseBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "last_response_bytes",
+		Help:      "Size of the most recent response body received from API.",
+	}, e.withStaticLabels("location"))
+
+	e.elevationDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "location",
+		Name:      "elevation_meters",
+		Help:      "Elevation of the grid cell used for the location, as reported by API.",
+	}, e.withStaticLabels("location"))
+
+	e.utcOffsetDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "location",
+		Name:      "utc_offset_seconds",
+		Help:      "Offset of timezone used by API for the location from UTC.",
+	}, e.withStaticLabels("location"))
+
+	e.timezoneDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "location",
+		Name:      "timezone",
+		Help:      "Timezone used by API for forecast times of the location, value is always 1.",
+	}, e.withStaticLabels("location", "timezone", "abbreviation"))
 
 	e.totalScrapes = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
@@ -225,20 +916,85 @@ func (e *exporter) init() {
 		Help:      "Total number of times this exporter was scraped for metrics.",
 	})
 
-	e.scrapeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	e.scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: subsystem,
 		Name:      "scrape_errors",
 		Help:      "Total number of times an error occurred during scraping operation.",
+	}, []string{"location", "type"})
+
+	e.rateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "rate_limited_total",
+		Help:      "Total number of requests rejected by API due to rate limiting.",
 	})
 
+	e.notModified = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "not_modified_total",
+		Help:      "Total number of conditional requests to which API responded that data were not modified.",
+	})
+
+	e.influxErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "influx_push_errors_total",
+		Help:      "Total number of failed pushes of data to InfluxDB.",
+	})
+
+	e.otlpErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "otlp_push_errors_total",
+		Help:      "Total number of failed pushes of metrics to OTLP endpoint.",
+	})
+
+	e.apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "api_errors_total",
+		Help:      "Total number of error responses received from API, by HTTP status.",
+	}, []string{"status"})
+
 	e.httpFetchDuration = prometheus.NewSummary(prometheus.SummaryOpts{
 		Namespace: namespace,
 		Subsystem: subsystem,
 		Name:      "http_fetch_duration",
-		Help:      "Total time spent on fetching data from api.open-meteo.com",
+		Help:      "Deprecated: use http_request_duration_seconds. Total time spent on fetching data from api.open-meteo.com",
 	})
 
+	e.generationTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "generationtime_ms",
+		Help:      "Time API spent on generating the most recent response of the location, in milliseconds.",
+	}, e.withStaticLabels("location"))
+
+	e.fetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "fetch_duration_seconds",
+		Help:      "Time spent on fetching data of the location, either from cache (hit) or from API (miss).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"location", "result"})
+
+	e.httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests to API, by host and HTTP status (error when request failed).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host", "status"})
+
+	e.httpResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "http_responses_total",
+		Help:      "Total number of HTTP responses received from API, by host and status code.",
+	}, []string{"host", "code"})
+
 	e.httpTraffic = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: subsystem,
@@ -253,17 +1009,313 @@ func (e *exporter) init() {
 		Help:      "Total number of times cache was hit",
 	}, []string{"location"})
 
+	e.cacheMiss = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cache_miss",
+		Help:      "Total number of times cache was missed",
+	}, []string{"location"})
+
+	e.cacheHitRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cache_hit_ratio",
+		Help:      "Ratio of cache hits to all cache lookups.",
+	}, e.withStaticLabels("location"))
+
+	e.implausibleValues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "implausible_values_total",
+		Help:      "Total number of values received from API that were outside of configured plausible range.",
+	}, []string{"location", "metric"})
+
+	e.metricFamilies = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "metric_families",
+		Help:      "Number of metric families this exporter produces.",
+	})
+
+	e.staleEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "stale_entries",
+		Help:      "Number of cache entries which exceeded their TTL at the time of scrape.",
+	})
+
+	e.up = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "up",
+		Help:      "Whether the last fetch of the location, either from API or from cache, succeeded.",
+	}, e.withStaticLabels("location"))
+
+	e.lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Time when data of the location served by the last successful fetch were retrieved from API.",
+	}, e.withStaticLabels("location"))
+
+	e.cacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cache_entries",
+		Help:      "Number of entries in cache.",
+	})
+
+	e.cacheAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cache_entry_age_seconds",
+		Help:      "Age of cached data of the location.",
+	}, e.withStaticLabels("location"))
+
+	e.concurrency = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "configured_concurrency",
+		Help:      "Number of locations scraped concurrently.",
+	})
+
+	e.requestTimeout = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "request_timeout_seconds",
+		Help:      "Timeout of HTTP requests to API.",
+	})
+
+	e.locationTimeout = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "location_timeout_seconds",
+		Help:      "Timeout of fetch of the location including retries, for locations which set their own timeout.",
+	}, e.withStaticLabels("location"))
+
+	e.initialFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "initial_scrape_failures",
+		Help:      "Number of locations which failed their first fetch after start.",
+	})
+
+	e.configMtime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "config_file_mtime_seconds",
+		Help:      "Modification time of the loaded config file (newest fragment of config directory), in seconds since epoch.",
+	})
+}
+
+// setConfigMtime exports modification time of config file, zero time is unknown and leaves it unchanged.
+func (e *exporter) setConfigMtime(mtime time.Time) {
+	if !mtime.IsZero() {
+		e.configMtime.Set(float64(mtime.Unix()))
+	}
+}
+
+// reloadableTransport is http.RoundTripper which delegates to transport that can be replaced
+// while requests are in flight.
+type reloadableTransport struct {
+	current atomic.Pointer[http.Transport]
+}
+
+func (t *reloadableTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.current.Load().RoundTrip(r)
+}
+
+// initClient creates HTTP client used to access API. Probes share client of root exporter instead.
+func (e *exporter) initClient() {
+	if e.httpTimeout <= 0 {
+		e.httpTimeout = defaultHttpTimeout
+	}
+	e.transport = &reloadableTransport{}
+	e.transport.current.Store(e.newTransport())
 	e.client = http.Client{
-		Timeout: time.Second * 30,
+		Timeout:   e.httpTimeout,
+		Transport: e.transport,
 	}
+	e.requestTimeout.Set(e.client.Timeout.Seconds())
 }
 
-func NewExporter(config *types.Config, logger *slog.Logger) prometheus.Collector {
+// newTransport creates HTTP transport according to proxy and TLS settings of current config.
+func (e *exporter) newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:             e.proxy(),
+		TLSClientConfig:   e.tlsConfig(),
+		ForceAttemptHTTP2: true,
+	}
+}
+
+// updateLocationTimeouts exports timeout of every location which sets its own.
+func (e *exporter) updateLocationTimeouts() {
+	e.locationTimeout.Reset()
+	for _, loc := range e.cfg().Locations {
+		if loc.TimeoutSeconds > 0 {
+			e.locationTimeout.WithLabelValues(e.locationLabelValues(loc)...).Set(float64(loc.TimeoutSeconds))
+		}
+	}
+}
+
+// proxy returns proxy function of HTTP transport. Proxy from config takes precedence over environment variables
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY. Unlike http.ProxyFromEnvironment, which reads them only once per process,
+// environment is read whenever client is created.
+func (e *exporter) proxy() func(*http.Request) (*url.URL, error) {
+	if e.cfg().Proxy != "" {
+		if u, err := url.Parse(e.cfg().Proxy); err == nil {
+			return http.ProxyURL(u)
+		}
+		e.logger.Warn("Ignoring invalid proxy URL")
+	}
+	proxyFunc := httpproxy.FromEnvironment().ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxyFunc(r.URL)
+	}
+}
+
+// tlsConfig returns TLS configuration of HTTP transport, or nil when defaults are fine.
+func (e *exporter) tlsConfig() *tls.Config {
+	if e.cfg().CAFile == "" && !e.cfg().InsecureSkipVerify {
+		return nil
+	}
+	tc := &tls.Config{InsecureSkipVerify: e.cfg().InsecureSkipVerify}
+	if e.cfg().CAFile != "" {
+		pool, err := types.LoadCAFile(e.cfg().CAFile)
+		if err != nil {
+			e.logger.Error("Couldn't load CA file, using system roots", "path", e.cfg().CAFile, "error", err)
+		} else {
+			tc.RootCAs = pool
+		}
+	}
+	return tc
+}
+
+// cfg returns current configuration.
+func (e *exporter) cfg() *types.Config {
+	return e.config.Load()
+}
+
+// Reload replaces configuration of running exporter and restarts scheduled and background refreshes.
+// Cache entries of locations which still exist are preserved, series of removed locations are deleted.
+func (e *exporter) Reload(config *types.Config, configMtime time.Time) error {
+	e.reloadLock.Lock()
+	defer e.reloadLock.Unlock()
+	if e.stopped {
+		return errStopped
+	}
+	e.schedCancel()
+	e.schedWg.Wait()
+	e.stopOTLP()
+	old := e.config.Swap(config)
+	if config.RequestsPerMinute != old.RequestsPerMinute {
+		e.limiter.Store(newRateLimiter(config.RequestsPerMinute))
+	}
+	// proxy, ca_file and insecure_skip_verify apply to new connections, requests in flight finish on old ones
+	e.transport.current.Swap(e.newTransport()).CloseIdleConnections()
+
+	keep := map[string]bool{}
+	locs := map[string]types.Location{}
+	for _, loc := range config.Locations {
+		keep[e.cacheKey(loc)] = true
+		locs[loc.Name] = loc
+	}
+	e.cacheLock.Lock()
+	for key := range e.cache {
+		if !keep[key] {
+			delete(e.cache, key)
+		}
+	}
+	e.cacheLock.Unlock()
+	if !slices.Equal(e.staticLabels, config.LabelKeys()) {
+		e.logger.Warn("Keys of static labels changed, restart is required for new keys to take effect",
+			"keys", strings.Join(e.staticLabels, ","))
+	}
+	for _, loc := range old.Locations {
+		// series of location with changed labels would otherwise linger with old values
+		n, ok := locs[loc.Name]
+		if !ok {
+			e.deleteSeries(loc)
+		} else if labelsChanged(loc, n) {
+			e.resetSeries(loc)
+			for _, gv := range e.statusGauges() {
+				gv.DeletePartialMatch(prometheus.Labels{"location": loc.Name})
+			}
+		}
+	}
+
+	e.concurrency.Set(float64(e.maxConcurrency()))
+	e.updateLocationTimeouts()
+	e.schedCtx, e.schedCancel = context.WithCancel(e.ctx)
+	if e.started {
+		e.startBackground(e.schedCtx)
+	}
+	if e.checkCapabilities {
+		e.startCapabilitiesCheck(e.schedCtx)
+	}
+	e.setConfigMtime(configMtime)
+	e.logger.Info("Configuration reloaded", "locations", len(config.Locations))
+	return nil
+}
+
+// errStopped is returned by Reload of stopped exporter.
+var errStopped = errors.New("exporter is stopped")
+
+func (e *exporter) Stop() {
+	e.reloadLock.Lock()
+	defer e.reloadLock.Unlock()
+	if e.stopped {
+		return
+	}
+	e.stopped = true
+	e.cancel()
+	e.schedWg.Wait()
+	e.stopOTLP()
+	if e.cfg().CachePath != "" {
+		if err := e.saveCache(); err != nil {
+			e.logger.Error("Couldn't save cache to disk", "path", e.cfg().CachePath, "error", err)
+		}
+	}
+}
+
+// NewExporter creates exporter of configured locations, requests to API time out after httpTimeout.
+// Modification time of config file is exported, unless it's zero.
+func NewExporter(config *types.Config, configMtime time.Time, logger *slog.Logger, httpTimeout time.Duration) Exporter {
+	e := newExporter(config, logger, httpTimeout, realClock{})
+	e.setConfigMtime(configMtime)
+	return e
+}
+
+func newExporter(config *types.Config, logger *slog.Logger, httpTimeout time.Duration, clk clock) *exporter {
 	e := &exporter{
-		logger: logger,
-		config: config,
-		cache:  map[string]types.CacheEntry{},
+		logger:      logger,
+		httpTimeout: httpTimeout,
+		clock:       clk,
+		cache:       map[string]types.CacheEntry{},
+		probeCache:  map[string]types.CacheEntry{},
+		status:      map[string]*locationStatus{},
+
+		capabilities: map[string]*statusError{},
+
+		backoffUntil: map[string]time.Time{},
 	}
+	e.root = e
+	e.config.Store(config)
+	e.limiter.Store(newRateLimiter(config.RequestsPerMinute))
+	e.ctx, e.cancel = context.WithCancel(context.Background())
 	e.init()
+	e.initClient()
+	e.weatherRegistry = prometheus.NewRegistry()
+	for _, gv := range e.weatherGauges() {
+		e.weatherRegistry.MustRegister(gv)
+	}
+	e.metricFamilies.Set(float64(e.countMetricFamilies()))
+	e.concurrency.Set(float64(e.maxConcurrency()))
+	e.updateLocationTimeouts()
+	if config.CachePath != "" {
+		if err := e.loadCache(); err != nil {
+			logger.Warn("Couldn't load cache from disk", "path", config.CachePath, "error", err)
+		}
+	}
+	e.schedCtx, e.schedCancel = context.WithCancel(e.ctx)
 	return e
 }
@@ -0,0 +1,323 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+func TestMetricFamiliesMatchDescribedAndCollected(t *testing.T) {
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{
+		{Name: "Bratislava", Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}},
+		{Name: "Kosice", Coordinates: types.Coordinates{Latitude: 48.72, Longitude: 21.26}},
+	}})
+	fakeApi(e, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+
+	described := map[string]bool{}
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		e.Describe(ch)
+		close(ch)
+	}()
+	for desc := range ch {
+		described[desc.String()] = true
+	}
+
+	// pedantic registry fails on collected metrics which weren't described, or which were collected more than once
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var families float64
+	for _, mf := range mfs {
+		if mf.GetName() == "openmeteo_exporter_metric_families" {
+			families = mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	if families != float64(len(described)) {
+		t.Fatalf("expected %d metric families, gauge reports %v", len(described), families)
+	}
+	if len(mfs) > len(described) {
+		t.Fatalf("collected %d metric families, but only %d were described", len(mfs), len(described))
+	}
+}
+
+func TestStopIsIdempotentAndRefusesReload(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	cfg := &types.Config{BackgroundRefresh: true, Locations: []types.Location{loc}}
+	e := newTestExporter(t, cfg)
+
+	e.Stop()
+	e.Stop()
+	if err := e.Reload(&types.Config{BackgroundRefresh: true, Locations: []types.Location{loc, loc}}, time.Time{}); err == nil {
+		t.Fatal("expected reload of stopped exporter to fail")
+	}
+	if e.cfg() != cfg {
+		t.Fatal("configuration of stopped exporter was replaced")
+	}
+}
+
+func TestConfiguredConcurrencyGauge(t *testing.T) {
+	e := newTestExporter(t, &types.Config{})
+	if got := testutil.ToFloat64(e.concurrency); got != defaultMaxConcurrency {
+		t.Fatalf("expected default concurrency %d, got %v", defaultMaxConcurrency, got)
+	}
+
+	if err := e.Reload(&types.Config{MaxConcurrency: 8}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(e.concurrency); got != 8 {
+		t.Fatalf("expected reloaded concurrency 8, got %v", got)
+	}
+	if got := testutil.ToFloat64(e.newProbe(types.Location{Name: "probe"}).concurrency); got != 8 {
+		t.Fatalf("expected probe to report concurrency 8, got %v", got)
+	}
+}
+
+func TestRequestTimeoutGauges(t *testing.T) {
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{
+		{Name: "Bratislava"},
+		{Name: "Vienna", TimeoutSeconds: 5},
+	}})
+	if got := testutil.ToFloat64(e.requestTimeout); got != 1 {
+		t.Fatalf("expected request timeout 1s, got %v", got)
+	}
+	expected := `
+# HELP openmeteo_exporter_location_timeout_seconds Timeout of fetch of the location including retries, for locations which set their own timeout.
+# TYPE openmeteo_exporter_location_timeout_seconds gauge
+openmeteo_exporter_location_timeout_seconds{location="Vienna"} 5
+`
+	if err := testutil.CollectAndCompare(e.locationTimeout, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Reload(&types.Config{Locations: []types.Location{{Name: "Vienna"}, {Name: "Budapest", TimeoutSeconds: 3}}}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	expected = `
+# HELP openmeteo_exporter_location_timeout_seconds Timeout of fetch of the location including retries, for locations which set their own timeout.
+# TYPE openmeteo_exporter_location_timeout_seconds gauge
+openmeteo_exporter_location_timeout_seconds{location="Budapest"} 3
+`
+	if err := testutil.CollectAndCompare(e.locationTimeout, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheHitRatio(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{
+		{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}},
+	}})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	// first scrape misses, following two are served from cache
+	for i := 0; i < 3; i++ {
+		if _, err := reg.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(e.cacheHitRatio.WithLabelValues("Bratislava")); got != 2.0/3 {
+		t.Fatalf("expected hit ratio 2/3, got %v", got)
+	}
+	if got := u.requests.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", got)
+	}
+}
+
+func TestInitialScrapeFailures(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("latitude") == "48.14" {
+			_, _ = io.WriteString(w, currentWeatherJson)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{
+		{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}},
+		{Name: "Kosice", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.72, Longitude: 21.26}},
+		{Name: "Vienna", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}},
+	}})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	expected := `
+# HELP openmeteo_exporter_initial_scrape_failures Number of locations which failed their first fetch after start.
+# TYPE openmeteo_exporter_initial_scrape_failures gauge
+openmeteo_exporter_initial_scrape_failures 2
+`
+	// later failures of the same locations aren't counted again
+	for i := 0; i < 2; i++ {
+		if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "openmeteo_exporter_initial_scrape_failures"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScrapeIsolatesPanickingLocation(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("latitude") == "2.00" {
+			_, _ = io.WriteString(w, `{"current": {"time": "2024-01-01T12:00", "uv_index": 3}}`)
+			return
+		}
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	alt := types.FetchMethod(types.FetchMethodAlt)
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{
+		{Name: "Panicking", FetchMethod: &alt, BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 2, Longitude: 2}},
+		{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}},
+	}})
+	// gauge with unexpected labels makes handler of alt method panic
+	e.uvIndexDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "uv_index"}, []string{"foo"})
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		e.scrape(context.Background(), ch)
+		close(ch)
+	}()
+	for range ch {
+	}
+	if got := testutil.ToFloat64(e.scrapeErrors.WithLabelValues("Panicking", errorTypeOther)); got != 1 {
+		t.Errorf("expected panic to be counted as error, got %v", got)
+	}
+	if got := testutil.CollectAndCount(e.tempDesc); got != 1 {
+		t.Errorf("expected series of healthy location, got %d", got)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var proxied atomic.Value
+	proxy := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// request sent through proxy carries absolute URL of the target
+		proxied.Store(r.URL.Host)
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: "http://api.open-meteo.invalid", Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	for _, tc := range []struct {
+		name     string
+		env      string
+		cfgProxy string
+	}{
+		{name: "environment", env: proxy.URL},
+		{name: "config", cfgProxy: proxy.URL},
+		{name: "config overrides environment", env: "http://127.0.0.1:1", cfgProxy: proxy.URL},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxied.Store("")
+			t.Setenv("HTTP_PROXY", tc.env)
+			e := newTestExporter(t, &types.Config{Proxy: tc.cfgProxy, Locations: []types.Location{loc}})
+
+			if _, err := e.fetch(context.Background(), loc, e.requestUri(loc), &types.Response{}); err != nil {
+				t.Fatal(err)
+			}
+			if got := proxied.Load(); got != "api.open-meteo.invalid" {
+				t.Fatalf("expected request to api.open-meteo.invalid through proxy, got %q", got)
+			}
+		})
+	}
+}
+
+func TestReloadAppliesProxy(t *testing.T) {
+	var proxied atomic.Value
+	proxy := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.Host)
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	t.Setenv("HTTP_PROXY", "")
+	loc := types.Location{Name: "Bratislava", BaseURL: "http://api.open-meteo.invalid", Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+	if err := e.Reload(&types.Config{Proxy: proxy.URL, Locations: []types.Location{loc}}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.fetch(context.Background(), loc, e.requestUri(loc), &types.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := proxied.Load(); got != "api.open-meteo.invalid" {
+		t.Fatalf("expected request to api.open-meteo.invalid through proxy, got %q", got)
+	}
+}
+
+func TestReloadDeletesOutdatedSeries(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	a := types.Location{Name: "A", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	b := types.Location{Name: "B", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.72, Longitude: 21.26}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{a, b}})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A is removed, B only changes unit of temperature
+	b.TemperatureUnit = types.TemperatureUnitFahrenheit
+	if err := e.Reload(&types.Config{Locations: []types.Location{b}}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP openmeteo_up Whether the last fetch of the location, either from API or from cache, succeeded.
+# TYPE openmeteo_up gauge
+openmeteo_up{location="B"} 1
+# HELP openmeteo_current_temperature The current temperature.
+# TYPE openmeteo_current_temperature gauge
+openmeteo_current_temperature{latitude="48.72",location="B",longitude="21.26",model="",unit="fahrenheit"} 3.5
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "openmeteo_up", "openmeteo_current_temperature"); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "location" && lp.GetValue() == "A" {
+					t.Errorf("unexpected series of removed location in %s", mf.GetName())
+				}
+			}
+		}
+	}
+	e.statusLock.Lock()
+	defer e.statusLock.Unlock()
+	if _, ok := e.status["A"]; ok {
+		t.Error("expected status of removed location to be dropped")
+	}
+}
@@ -18,173 +18,1107 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
 	"github.com/rkosegi/open-meteo-exporter/types"
+	"golang.org/x/sync/singleflight"
 )
 
-func (e *exporter) handleDefault(loc types.Location, ch chan<- prometheus.Metric) {
-	var respObj types.Response
-	if loc.TtlMinutes == 0 {
-		loc.TtlMinutes = 10
+var altCurrentVars = []string{
+	"temperature_2m",
+	"relative_humidity_2m",
+	"apparent_temperature",
+	"is_day",
+	"precipitation",
+	"rain",
+	"showers",
+	"snowfall",
+	"weather_code",
+	"cloud_cover",
+	"pressure_msl",
+	"surface_pressure",
+	"wind_speed_10m",
+	"wind_direction_10m",
+	"wind_speed_80m",
+	"wind_direction_80m",
+	"wind_speed_120m",
+	"wind_direction_120m",
+	"wind_speed_180m",
+	"wind_direction_180m",
+	"wind_gusts_10m",
+	"uv_index",
+	"visibility",
+	"dew_point_2m",
+	"cloud_cover_low",
+	"cloud_cover_mid",
+	"cloud_cover_high",
+	"soil_temperature_0cm",
+	"soil_temperature_6cm",
+	"soil_temperature_18cm",
+	"soil_temperature_54cm",
+	"soil_moisture_0_to_1cm",
+	"soil_moisture_1_to_3cm",
+	"soil_moisture_3_to_9cm",
+	"soil_moisture_9_to_27cm",
+	"soil_moisture_27_to_81cm",
+	"et0_fao_evapotranspiration",
+	"vapour_pressure_deficit",
+}
+
+var dailyVars = []string{
+	"temperature_2m_max",
+	"temperature_2m_min",
+}
+
+var hourlyVars = []string{
+	"temperature_2m",
+	"precipitation_probability",
+}
+
+var airQualityVars = []string{
+	"european_aqi",
+	"us_aqi",
+}
+
+var marineVars = []string{
+	"wave_height",
+	"wave_direction",
+	"wave_period",
+	"swell_wave_height",
+	"swell_wave_period",
+}
+
+// buildUri composes request URI from base and query parameters.
+// Parameters are always encoded sorted by key, so same location yields same URI.
+func buildUri(base string, params url.Values) string {
+	return base + "?" + params.Encode()
+}
+
+func locationParams(loc types.Location) url.Values {
+	params := url.Values{}
+	lat, lon := coordinateLabels(loc)
+	params.Set("latitude", lat)
+	params.Set("longitude", lon)
+	return params
+}
+
+type forceFetchKey struct{}
+
+// withForceFetch marks context so that fetch bypasses cache.
+func withForceFetch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceFetchKey{}, true)
+}
+
+func isForceFetch(ctx context.Context) bool {
+	force, _ := ctx.Value(forceFetchKey{}).(bool)
+	return force
+}
+
+// isFresh decides whether cache entry can be served instead of fetching new data.
+// Locations with schedule or refreshed in background are only refreshed by background goroutine,
+// so any entry is considered fresh, as long as the last refresh succeeded. Otherwise, expired entry is fetched
+// by scrape, like it would be without background refresh.
+func (e *exporter) isFresh(loc types.Location, entry types.CacheEntry) bool {
+	if loc.Schedule != "" || e.cfg().BackgroundRefresh {
+		e.statusLock.Lock()
+		failing := e.locStatus(loc.Name).failures > 0
+		e.statusLock.Unlock()
+		if !failing {
+			return true
+		}
+	}
+	return time.Now().Unix() < int64(e.ttl(loc).Seconds())+entry.LastUpdate.Unix()
+}
+
+// ttl returns how long cached response of location is considered fresh.
+// When location doesn't set TTL, configured default is used, or 10 minutes.
+func (e *exporter) ttl(loc types.Location) time.Duration {
+	switch {
+	case loc.TtlMinutes > 0:
+		return time.Duration(loc.TtlMinutes) * time.Minute
+	case e.cfg().DefaultTtlMinutes > 0:
+		return time.Duration(e.cfg().DefaultTtlMinutes) * time.Minute
 	}
+	return 10 * time.Minute
+}
 
-	var fetch = true
-	last, present := e.cache[loc.Name]
-	if present {
-		if time.Now().Unix() < int64(loc.TtlMinutes*60)+last.LastUpdate.Unix() {
-			fetch = false
-			e.cacheHit.WithLabelValues(loc.Name).Inc()
+// forecastDays returns number of forecast days to request for location, defaults to 1.
+func forecastDays(loc types.Location) int {
+	if loc.ForecastDays > 0 {
+		return loc.ForecastDays
+	}
+	return 1
+}
+
+// forecastHours returns number of hours ahead to export for location, defaults to 24.
+func forecastHours(loc types.Location) int {
+	if loc.ForecastHours > 0 {
+		return loc.ForecastHours
+	}
+	return 24
+}
+
+// temperatureUnit returns temperature unit of location, defaults to celsius.
+func temperatureUnit(loc types.Location) string {
+	if loc.TemperatureUnit != "" {
+		return loc.TemperatureUnit
+	}
+	return types.TemperatureUnitCelsius
+}
+
+// precipitationUnit returns unit of precipitation, rain and showers of location, defaults to mm.
+func precipitationUnit(loc types.Location) string {
+	if loc.PrecipitationUnit != "" {
+		return loc.PrecipitationUnit
+	}
+	return types.PrecipitationUnitMm
+}
+
+// snowfallUnit returns unit of snowfall of location, API reports snowfall in centimeters, unless unit is inch.
+func snowfallUnit(loc types.Location) string {
+	if unit := precipitationUnit(loc); unit != types.PrecipitationUnitMm {
+		return unit
+	}
+	return "cm"
+}
+
+// windSpeedUnit returns wind speed unit of location, defaults to kmh.
+func windSpeedUnit(loc types.Location) string {
+	if loc.WindSpeedUnit != "" {
+		return loc.WindSpeedUnit
+	}
+	return types.WindSpeedUnitKmh
+}
+
+// timezone returns timezone in which daily and hourly forecasts of location are requested,
+// defaults to auto, which lets API resolve timezone from coordinates.
+func timezone(loc types.Location) string {
+	if loc.Timezone != "" {
+		return loc.Timezone
+	}
+	return types.TimezoneAuto
+}
+
+// methodOf returns fetch method of location, defaulting to FetchMethodDefault.
+func methodOf(loc types.Location) types.FetchMethod {
+	if loc.FetchMethod == nil {
+		return types.FetchMethodDefault
+	}
+	return *loc.FetchMethod
+}
+
+// forecastUri returns endpoint of forecast API for location, either from location, from config or public one.
+func (e *exporter) forecastUri(loc types.Location) string {
+	if loc.BaseURL != "" {
+		return loc.BaseURL
+	}
+	if e.cfg().BaseURL != "" {
+		return e.cfg().BaseURL
+	}
+	return baseUri
+}
+
+// apiUri returns endpoint of API other than forecast one for location. Self-hosted instance serves all APIs
+// next to each other, so when base URL is configured, endpoint is derived from it by replacing its last path element.
+func (e *exporter) apiUri(loc types.Location, public string) string {
+	base := e.forecastUri(loc)
+	if base == baseUri {
+		return public
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return public
+	}
+	u.Path = path.Join("/", path.Dir(u.Path), path.Base(public))
+	return u.String()
+}
+
+// customerUri returns endpoint of commercial API corresponding to public endpoint, other endpoints are returned as is.
+func customerUri(uri string) string {
+	switch uri {
+	case baseUri, airQualityUri, marineUri, floodUri:
+		return strings.Replace(uri, "https://", "https://customer-", 1)
+	}
+	return uri
+}
+
+// requestUri returns URI of API request for location, according to its fetch method.
+// When API key is configured, it's appended to query and commercial endpoint is used.
+func (e *exporter) requestUri(loc types.Location) string {
+	params := locationParams(loc)
+	base := e.forecastUri(loc)
+	switch methodOf(loc) {
+	case types.FetchMethodAlt:
+		params.Set("current", strings.Join(altCurrentVars, ","))
+	case types.FetchMethodDaily:
+		params.Set("daily", strings.Join(dailyVars, ","))
+		params.Set("forecast_days", strconv.Itoa(forecastDays(loc)))
+		params.Set("timezone", timezone(loc))
+	case types.FetchMethodHourly:
+		params.Set("hourly", strings.Join(hourlyVars, ","))
+		params.Set("timezone", timezone(loc))
+		// one extra hour, so that offsets 0..hours are all available
+		params.Set("forecast_hours", strconv.Itoa(forecastHours(loc)+1))
+		// forecast_days limits period of forecast, which forecast_hours narrows further
+		if loc.ForecastDays > 0 {
+			params.Set("forecast_days", strconv.Itoa(loc.ForecastDays))
 		}
+	case types.FetchMethodAirQuality:
+		params.Set("current", strings.Join(airQualityVars, ","))
+		base = e.apiUri(loc, airQualityUri)
+	case types.FetchMethodMarine:
+		params.Set("current", strings.Join(marineVars, ","))
+		base = e.apiUri(loc, marineUri)
+	case types.FetchMethodFlood:
+		params.Set("daily", "river_discharge")
+		params.Set("forecast_days", strconv.Itoa(forecastDays(loc)))
+		base = e.apiUri(loc, floodUri)
+	default:
+		params.Set("current_weather", "true")
+	}
+	if loc.TemperatureUnit != "" {
+		params.Set("temperature_unit", loc.TemperatureUnit)
+	}
+	if loc.Models != "" {
+		params.Set("models", loc.Models)
+	}
+	if loc.Elevation != nil {
+		params.Set("elevation", strconv.FormatFloat(*loc.Elevation, 'f', -1, 64))
+	}
+	if loc.PrecipitationUnit != "" {
+		params.Set("precipitation_unit", loc.PrecipitationUnit)
+	}
+	if loc.WindSpeedUnit != "" {
+		params.Set("wind_speed_unit", loc.WindSpeedUnit)
+	}
+	if e.cfg().APIKey != "" {
+		params.Set("apikey", e.cfg().APIKey)
+		base = customerUri(base)
 	}
-	if fetch {
-		var uri = fmt.Sprintf("%s?latitude=%.2f&longitude=%.2f&current_weather=true",
-			baseUri, loc.Latitude, loc.Longitude)
+	return buildUri(base, params)
+}
 
-		req, err := http.NewRequest(http.MethodGet, uri, nil)
-		if err != nil {
-			e.onError(err)
-			return
+// apiKeyParam matches API key in query of request URI, it's matched textually, because URI might not even parse.
+var apiKeyParam = regexp.MustCompile(`([?&]apikey=)[^&#]*`)
+
+// redactErr removes API key from URL carried by err, so that it never ends up in logs.
+func redactErr(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = apiKeyParam.ReplaceAllString(ue.URL, "${1}REDACTED")
+	}
+	return err
+}
+
+// cacheKey returns key under which response for location is cached.
+// Key is derived from normalized coordinates and fetch method, so that locations sharing the same point share one fetch.
+// Hash of request URI is appended, because such locations can still differ in other options, such as units.
+// Key is namespaced by configured prefix. Cache is private to exporter (and its probes), so prefix is reserved
+// for cache store shared by multiple instances, where it keeps their keys apart.
+func (e *exporter) cacheKey(loc types.Location) string {
+	params := locationParams(loc)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(e.requestUri(loc)))
+	return fmt.Sprintf("%s%s,%s,%s,%08x", e.cfg().CacheKeyPrefix,
+		params.Get("latitude"), params.Get("longitude"), methodOf(loc), h.Sum32())
+}
+
+// cached returns cache entry of location.
+// Cache is accessed concurrently by scrapes, background refreshes and HTTP handlers,
+// so it must never be accessed without holding cacheLock.
+// Probes can use entries of configured locations, but they store their own entries to probe cache.
+func (e *exporter) cached(loc types.Location) (types.CacheEntry, bool) {
+	key := e.cacheKey(loc)
+	e.root.cacheLock.RLock()
+	defer e.root.cacheLock.RUnlock()
+	entry, present := e.root.cache[key]
+	if !present && e.root != e {
+		entry, present = e.root.probeCache[key]
+	}
+	return entry, present
+}
+
+// store puts cache entry of location to cache, or to probe cache when e is probe.
+func (e *exporter) store(loc types.Location, entry types.CacheEntry) {
+	key := e.cacheKey(loc)
+	e.root.cacheLock.Lock()
+	defer e.root.cacheLock.Unlock()
+	if e.root == e {
+		e.root.cache[key] = entry
+		return
+	}
+	e.evictProbeEntries(e.ttl(loc))
+	e.root.probeCache[key] = entry
+}
+
+// evictProbeEntries drops entries of probe cache older than ttl. When cache is still full afterward,
+// oldest entry is dropped as well to make room for new one. Caller must hold cacheLock.
+func (e *exporter) evictProbeEntries(ttl time.Duration) {
+	var oldest string
+	for key, entry := range e.root.probeCache {
+		if time.Since(entry.LastUpdate) >= ttl {
+			delete(e.root.probeCache, key)
+		} else if oldest == "" || entry.LastUpdate.Before(e.root.probeCache[oldest].LastUpdate) {
+			oldest = key
 		}
-		req.Header.Set("accept", "application/json")
-		req.Header.Set("content-type", "application/json")
+	}
+	if len(e.root.probeCache) >= maxProbeCacheEntries {
+		delete(e.root.probeCache, oldest)
+	}
+}
+
+// correlationId returns stable identifier of location, derived from its name,
+// so that all activity related to single location can be correlated across logs and upstream requests.
+func correlationId(name string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// locLogger returns logger with location and its correlation ID attached.
+func (e *exporter) locLogger(loc types.Location) *slog.Logger {
+	return e.logger.With("location", loc.Name, "correlation_id", correlationId(loc.Name))
+}
 
-		resp, err := e.client.Do(req)
+// fetch returns response for location, either from cache or by calling API at given uri.
+// Freshly fetched data are decoded into respObj, which is then stored in cache.
+func (e *exporter) fetch(ctx context.Context, loc types.Location, uri string, respObj interface{}) (interface{}, error) {
+	resp, hit, err := e.doFetch(ctx, loc, uri, respObj)
+	if err != nil {
+		e.locLogger(loc).Debug("Fetch failed", "error", err)
+		// deferred, so that failure is already counted
+		defer e.dropStaleSeries(loc)
+	}
+	e.statusLock.Lock()
+	st := e.locStatus(loc.Name)
+	if hit {
+		// serving from cache says nothing about API, so outcome of the last fetch is kept
+		if st.failures == 0 {
+			e.up.WithLabelValues(e.locationLabelValues(loc)...).Set(1)
+			// series may have been deleted by reload, while cached data are still served
+			if entry, present := e.cached(loc); present {
+				e.lastSuccess.WithLabelValues(e.locationLabelValues(loc)...).Set(float64(entry.LastUpdate.Unix()))
+			}
+		}
+		e.statusLock.Unlock()
+		return resp, nil
+	}
+	if err != nil {
+		st.failures++
+		st.lastError = err.Error()
+		st.lastErrorTime = time.Now()
+		e.up.WithLabelValues(e.locationLabelValues(loc)...).Set(0)
+	} else {
+		st.failures = 0
+		e.up.WithLabelValues(e.locationLabelValues(loc)...).Set(1)
+		if entry, present := e.cached(loc); present {
+			e.lastSuccess.WithLabelValues(e.locationLabelValues(loc)...).Set(float64(entry.LastUpdate.Unix()))
+		}
+	}
+	if !st.attempted {
+		st.attempted = true
 		if err != nil {
-			e.onError(err)
-			return
+			e.initialFailures.Inc()
 		}
+	}
+	e.statusLock.Unlock()
+	return resp, err
+}
+
+// userAgent returns User-Agent header of requests to API.
+func (e *exporter) userAgent() string {
+	if e.cfg().UserAgent != "" {
+		return e.cfg().UserAgent
+	}
+	return "openmeteo_exporter/" + version.Version
+}
 
-		defer func(body io.Closer) {
-			_ = body.Close()
-		}(resp.Body)
+// statusError is returned when API responds with status other than 2xx.
+// Reason is explanation provided by API, if any.
+type statusError struct {
+	StatusCode int
+	Reason     string
+}
 
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			e.onError(err)
-			return
+func (e *statusError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("API responded with HTTP status %d: %s", e.StatusCode, e.Reason)
+	}
+	return fmt.Sprintf("unexpected HTTP status %d", e.StatusCode)
+}
+
+// defaultRetryAfter is backoff used when rate-limited response doesn't specify valid Retry-After
+const defaultRetryAfter = time.Minute
+
+// rateLimitedError is returned when requests to host are suspended due to rate limiting.
+type rateLimitedError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("requests to %s are rate-limited until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+// parseRetryAfter parses value of Retry-After header, which is either number of seconds or HTTP date.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return defaultRetryAfter
+}
+
+// checkBackoff returns error if requests to host are suspended due to rate limiting.
+func (e *exporter) checkBackoff(host string) error {
+	e.root.backoffLock.Lock()
+	defer e.root.backoffLock.Unlock()
+	if until, ok := e.root.backoffUntil[host]; ok && time.Now().Before(until) {
+		return &rateLimitedError{Host: host, Until: until}
+	}
+	return nil
+}
+
+const (
+	errorTypeNetwork = "network"
+	errorTypeTimeout = "timeout"
+	errorTypeHttp    = "http"
+	errorTypeParse   = "parse"
+	errorTypeOther   = "other"
+)
+
+// errorType classifies error of fetch for the purpose of error counting.
+func errorType(err error) string {
+	var (
+		ne  net.Error
+		se  *statusError
+		rle *rateLimitedError
+		jse *json.SyntaxError
+		jte *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return errorTypeTimeout
+	case errors.As(err, &se), errors.As(err, &rle):
+		return errorTypeHttp
+	case errors.As(err, &jse), errors.As(err, &jte):
+		return errorTypeParse
+	case errors.As(err, &ne):
+		return errorTypeNetwork
+	}
+	return errorTypeOther
+}
+
+// retryable returns true for network errors and 5xx responses, which are likely transient.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= http.StatusInternalServerError
+	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+// backoff returns jittered exponential delay before retry attempt (counted from 0).
+func (e *exporter) backoff(attempt int) time.Duration {
+	base := e.cfg().RetryBackoff
+	if base <= 0 {
+		base = time.Second
+	}
+	d := base << attempt
+	return d/2 + rand.N(d)
+}
+
+// validators of response, which make following request for the same data conditional.
+type validators struct {
+	ETag         string
+	LastModified string
+}
+
+// errNotModified is returned when API responds to conditional request with 304
+var errNotModified = errors.New("not modified")
+
+// get performs GET request to API and returns response body along with its validators.
+// Transient failures are retried up to configured number of times, as long as context allows.
+// When cond is not nil, request is conditional and errNotModified is returned if data didn't change.
+func (e *exporter) get(ctx context.Context, uri string, correlation string, cond *validators) ([]byte, validators, error) {
+	for attempt := 0; ; attempt++ {
+		data, v, err := e.getOnce(ctx, uri, correlation, cond)
+		if err == nil || attempt >= e.cfg().MaxRetries || !retryable(err) {
+			return data, v, err
 		}
-		e.httpTraffic.Add(float64(len(data)))
-		err = json.Unmarshal(data, &respObj)
-		if err != nil {
-			e.onError(err)
-			return
+		delay := e.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return nil, validators{}, err
 		}
-		e.cache[loc.Name] = types.CacheEntry{
-			Response:   &respObj,
-			LastUpdate: time.Now(),
+		e.logger.Debug("Retrying request", "correlation_id", correlation, "attempt", attempt+1, "delay", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, validators{}, err
+		case <-timer.C:
 		}
-	} else {
-		respObj = *last.Response.(*types.Response)
 	}
-	e.tempDesc.WithLabelValues(loc.Name).Set(respObj.CurrentWeather.Temperature)
-	e.windSpeedDesc.WithLabelValues(loc.Name).Set(respObj.CurrentWeather.WindSpeed)
-	e.windDirDesc.WithLabelValues(loc.Name).Set(respObj.CurrentWeather.WindDirection)
-
-	e.tempDesc.Collect(ch)
-	e.windSpeedDesc.Collect(ch)
-	e.windDirDesc.Collect(ch)
-	e.cacheHit.Collect(ch)
 }
 
-func (e *exporter) handleAlt(loc types.Location, ch chan<- prometheus.Metric) {
-	var respObj types.ResponseAlt
-	if loc.TtlMinutes == 0 {
-		loc.TtlMinutes = 10
+// getOnce performs single GET request to API and returns response body along with its validators.
+func (e *exporter) getOnce(ctx context.Context, uri string, correlation string, cond *validators) ([]byte, validators, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, validators{}, redactErr(err)
+	}
+	if err = e.checkBackoff(req.URL.Host); err != nil {
+		return nil, validators{}, err
+	}
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("X-Correlation-ID", correlation)
+	req.Header.Set("User-Agent", e.userAgent())
+	if cond != nil {
+		if cond.ETag != "" {
+			req.Header.Set("If-None-Match", cond.ETag)
+		}
+		if cond.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cond.LastModified)
+		}
 	}
 
-	var fetch = true
-	entry, present := e.cache[loc.Name]
-	if present {
-		if time.Now().Unix() < int64(loc.TtlMinutes*60)+entry.LastUpdate.Unix() {
-			fetch = false
+	if err = e.root.limiter.Load().Wait(ctx); err != nil {
+		return nil, validators{}, err
+	}
+	start := time.Now()
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.httpDuration.WithLabelValues(req.URL.Host, "error").Observe(time.Since(start).Seconds())
+		return nil, validators{}, redactErr(err)
+	}
+
+	e.httpResponses.WithLabelValues(req.URL.Host, strconv.Itoa(resp.StatusCode)).Inc()
+	defer func(body io.Closer) {
+		_ = body.Close()
+	}(resp.Body)
+
+	data, err := io.ReadAll(resp.Body)
+	e.httpDuration.WithLabelValues(req.URL.Host, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, validators{}, err
+	}
+	e.httpTraffic.Add(float64(len(data)))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		until := time.Now().Add(parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+		e.root.backoffLock.Lock()
+		e.root.backoffUntil[req.URL.Host] = until
+		e.root.backoffLock.Unlock()
+		e.rateLimited.Inc()
+		e.logger.Warn("Rate-limited by API, suspending requests", "host", req.URL.Host, "until", until)
+		return nil, validators{}, &rateLimitedError{Host: req.URL.Host, Until: until}
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		e.notModified.Inc()
+		return nil, validators{}, errNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e.apiErrors.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+		var apiErr types.APIError
+		_ = json.Unmarshal(data, &apiErr)
+		return nil, validators{}, &statusError{StatusCode: resp.StatusCode, Reason: apiErr.Reason}
+	}
+	return data, validators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
+
+// doFetch returns response for location and whether it was served from cache.
+func (e *exporter) doFetch(ctx context.Context, loc types.Location, uri string, respObj interface{}) (interface{}, bool, error) {
+	start := time.Now()
+	if !isForceFetch(ctx) {
+		entry, present := e.cached(loc)
+		hit := present && e.isFresh(loc, entry)
+		e.statusLock.Lock()
+		st := e.locStatus(loc.Name)
+		prefetched, prefetchDuration := st.prefetched, st.prefetchDuration
+		st.prefetched = 0
+		if hit && prefetched == 0 {
+			st.cacheHits++
+		} else {
+			st.cacheMisses++
+		}
+		e.statusLock.Unlock()
+		if hit && prefetched > 0 {
+			// data were just fetched by batch, so lookup is accounted as miss, as if location was fetched alone
+			e.cacheMiss.WithLabelValues(loc.Name).Inc()
+			e.lastResponseBytes.WithLabelValues(e.locationLabelValues(loc)...).Set(float64(prefetched))
+			e.fetchDuration.WithLabelValues(loc.Name, "miss").Observe(prefetchDuration.Seconds())
+			return entry.Response, false, nil
+		}
+		if hit {
 			e.cacheHit.WithLabelValues(loc.Name).Inc()
+			e.locLogger(loc).Debug("Serving data from cache", "last_update", entry.LastUpdate)
+			e.fetchDuration.WithLabelValues(loc.Name, "hit").Observe(time.Since(start).Seconds())
+			return entry.Response, true, nil
 		}
+		e.cacheMiss.WithLabelValues(loc.Name).Inc()
 	}
-	if fetch {
-		var uri = fmt.Sprintf("%s?latitude=%.2f&longitude=%.2f&current=temperature_2m,relative_humidity_2m,"+
-			"apparent_temperature,is_day,precipitation,rain,showers,snowfall,weather_code,cloud_cover,pressure_msl,"+
-			"surface_pressure,wind_speed_10m,wind_direction_10m,wind_gusts_10m",
-			baseUri, loc.Latitude, loc.Longitude)
 
-		req, err := http.NewRequest(http.MethodGet, uri, nil)
-		if err != nil {
-			e.onError(err)
-			return
+	if loc.TimeoutSeconds > 0 {
+		// in-flight request is aborted once timeout of location elapses, which is reported as timeout error
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(loc.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	// concurrent misses of the same location (e.g. parallel scrapes or probes) share single request.
+	// Request must outlive whichever caller started it, so it runs detached from caller's context
+	// and every caller only waits for result until its own context is done.
+	ch := e.root.flight.DoChan(e.cacheKey(loc), func() (val interface{}, err error) {
+		// singleflight re-raises panic in goroutine of its own, where it would crash whole process
+		defer func() {
+			if r := recover(); r != nil {
+				val, err = nil, fmt.Errorf("panic while fetching location %s: %v", loc.Name, r)
+			}
+		}()
+		fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), e.fetchTimeout(loc))
+		defer cancel()
+		e.locLogger(loc).Debug("Fetching data from API", "method", methodOf(loc))
+		// request is conditional only when there is cached response to reuse, if API says it's not modified
+		var cond *validators
+		entry, present := e.cached(loc)
+		if present {
+			cond = &validators{ETag: entry.ETag, LastModified: entry.LastModified}
+		}
+		data, v, err := e.get(fctx, uri, correlationId(loc.Name), cond)
+		if errors.Is(err, errNotModified) && present {
+			e.locLogger(loc).Debug("Data not modified, reusing cached response")
+			entry.LastUpdate = time.Now()
+			e.store(loc, entry)
+			return fetchResult{response: entry.Response}, nil
 		}
-		req.Header.Set("accept", "application/json")
-		req.Header.Set("content-type", "application/json")
-
-		resp, err := e.client.Do(req)
 		if err != nil {
-			e.onError(err)
-			return
+			return nil, err
 		}
+		if err = json.Unmarshal(data, respObj); err != nil {
+			return nil, err
+		}
+		e.store(loc, types.CacheEntry{
+			Response:     respObj,
+			LastUpdate:   time.Now(),
+			ETag:         v.ETag,
+			LastModified: v.LastModified,
+		})
+		return fetchResult{response: respObj, size: len(data)}, nil
+	})
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		res.Err = ctx.Err()
+	}
+	e.fetchDuration.WithLabelValues(loc.Name, "miss").Observe(time.Since(start).Seconds())
+	if res.Err != nil {
+		return nil, false, res.Err
+	}
+	if res.Shared {
+		e.locLogger(loc).Debug("Shared in-flight request with concurrent fetch")
+	}
+	fr := res.Val.(fetchResult)
+	if fr.size > 0 {
+		e.lastResponseBytes.WithLabelValues(e.locationLabelValues(loc)...).Set(float64(fr.size))
+	}
+	return fr.response, false, nil
+}
 
-		defer func(body io.Closer) {
-			_ = body.Close()
-		}(resp.Body)
+// fetchResult is outcome of request shared by concurrent fetches, size is zero when cached response was reused.
+type fetchResult struct {
+	response interface{}
+	size     int
+}
 
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			e.onError(err)
+// fetchTimeout returns how long single fetch of location may take including retries.
+func (e *exporter) fetchTimeout(loc types.Location) time.Duration {
+	if loc.TimeoutSeconds > 0 {
+		return time.Duration(loc.TimeoutSeconds) * time.Second
+	}
+	return e.httpTimeout * time.Duration(e.cfg().MaxRetries+1)
+}
+
+// setGauge sets value of location's gauge, lvs are label values that follow location label.
+// Values of static labels of location are appended.
+// Non-finite values (NaN, Inf) are handled according to configured policy.
+// Values outside of plausible range configured for metric are flagged and optionally dropped.
+func (e *exporter) setGauge(loc types.Location, metric string, gv *prometheus.GaugeVec, v float64, lvs ...string) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		switch e.cfg().NonFinitePolicy {
+		case types.NonFinitePolicyKeep:
+		case types.NonFinitePolicyWarn:
+			e.locLogger(loc).Warn("Skipping non-finite value", "metric", metric, "value", v)
 			return
-		}
-		e.httpTraffic.Add(float64(len(data)))
-		err = json.Unmarshal(data, &respObj)
-		if err != nil {
-			e.onError(err)
+		default:
 			return
 		}
-		e.cache[loc.Name] = types.CacheEntry{
-			Response:   &respObj,
-			LastUpdate: time.Now(),
+	}
+	if r, ok := loc.Ranges[metric]; ok && !r.Contains(v) {
+		e.implausibleValues.WithLabelValues(loc.Name, metric).Inc()
+		if r.Drop {
+			return
 		}
-	} else {
-		respObj = *entry.Response.(*types.ResponseAlt)
 	}
+	lvs = append(append([]string{loc.Name}, lvs...), e.staticLabelValues(loc)...)
+	gv.WithLabelValues(lvs...).Set(v)
+}
+
+// setTimezone exports timezone info and UTC offset of location, replacing previous one if it has changed.
+func (e *exporter) setTimezone(loc types.Location, tz types.TimezoneInfo) {
+	if tz.Timezone == "" {
+		return
+	}
+	e.timezoneDesc.DeletePartialMatch(prometheus.Labels{"location": loc.Name})
+	lvs := append([]string{loc.Name, tz.Timezone, tz.TimezoneAbbreviation}, e.staticLabelValues(loc)...)
+	e.timezoneDesc.WithLabelValues(lvs...).Set(1)
+	if tz.UtcOffsetSeconds != nil {
+		e.setGauge(loc, "utc_offset_seconds", e.utcOffsetDesc, float64(*tz.UtcOffsetSeconds))
+	}
+}
+
+// coordinateLabels returns latitude and longitude of location formatted same way as in request.
+func coordinateLabels(loc types.Location) (string, string) {
+	return strconv.FormatFloat(loc.Latitude, 'f', 2, 64), strconv.FormatFloat(loc.Longitude, 'f', 2, 64)
+}
+
+// setGenerationTime exports time API spent on generating response of location.
+func (e *exporter) setGenerationTime(loc types.Location, gi types.GenerationInfo) {
+	if gi.GenerationTimeMs != nil {
+		e.generationTime.WithLabelValues(e.locationLabelValues(loc)...).Set(*gi.GenerationTimeMs)
+	}
+}
+
+// setObservationAge exports age of current observation, which API reports as ISO8601 time without timezone.
+// Current weather is always requested in GMT.
+func (e *exporter) setObservationAge(loc types.Location, observed string) {
+	if observed == "" {
+		return
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04", observed, time.UTC)
+	if err != nil {
+		e.locLogger(loc).Debug("Couldn't parse observation time", "time", observed, "error", err)
+		return
+	}
+	lat, lon := coordinateLabels(loc)
+	e.setGauge(loc, "observation_age_seconds", e.observationAgeDesc, time.Since(t).Seconds(), loc.Models, lat, lon)
+}
+
+func (e *exporter) handleDefault(ctx context.Context, loc types.Location) {
+	resp, err := e.fetch(ctx, loc, e.requestUri(loc), &types.Response{})
+	if err != nil {
+		e.onError(loc, errorType(err), err)
+		return
+	}
+	respObj := resp.(*types.Response)
+	lat, lon := coordinateLabels(loc)
+	e.setTimezone(loc, respObj.TimezoneInfo)
+	e.setGenerationTime(loc, respObj.GenerationInfo)
+	if respObj.Elevation != nil {
+		e.setGauge(loc, "elevation_meters", e.elevationDesc, *respObj.Elevation)
+	}
+	e.setObservationAge(loc, respObj.CurrentWeather.Time)
+	e.setGauge(loc, "temperature", e.tempDesc, respObj.CurrentWeather.Temperature, temperatureUnit(loc), loc.Models, lat, lon)
+	e.setGauge(loc, "wind_speed", e.windSpeedDesc, respObj.CurrentWeather.WindSpeed, "10m", windSpeedUnit(loc), loc.Models, lat, lon)
+	e.setGauge(loc, "wind_dir", e.windDirDesc, respObj.CurrentWeather.WindDirection, "10m", loc.Models, lat, lon)
+}
+
+func (e *exporter) handleAlt(ctx context.Context, loc types.Location) {
+	resp, err := e.fetch(ctx, loc, e.requestUri(loc), &types.ResponseAlt{})
+	if err != nil {
+		e.onError(loc, errorType(err), err)
+		return
+	}
+	respObj := resp.(*types.ResponseAlt)
+	lat, lon := coordinateLabels(loc)
+	e.setTimezone(loc, respObj.TimezoneInfo)
+	e.setGenerationTime(loc, respObj.GenerationInfo)
+	if respObj.Elevation != nil {
+		e.setGauge(loc, "elevation_meters", e.elevationDesc, *respObj.Elevation)
+	}
+	e.setObservationAge(loc, respObj.CurrentWeather.Time)
 	if respObj.CurrentWeather.Temperature != nil {
-		e.tempDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.Temperature)
+		e.setGauge(loc, "temperature", e.tempDesc, float64(*respObj.CurrentWeather.Temperature), temperatureUnit(loc), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.ApparentTemperature != nil {
-		e.tempApparentDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.ApparentTemperature)
+		e.setGauge(loc, "apparent_temperature", e.tempApparentDesc, float64(*respObj.CurrentWeather.ApparentTemperature), temperatureUnit(loc), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.RelativeHumidity != nil {
-		e.relHumidityDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.RelativeHumidity)
+		e.setGauge(loc, "relative_humidity", e.relHumidityDesc, float64(*respObj.CurrentWeather.RelativeHumidity), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.Precipitation != nil {
-		e.precipitationDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.Precipitation)
+		e.setGauge(loc, "precipitation", e.precipitationDesc, float64(*respObj.CurrentWeather.Precipitation), precipitationUnit(loc), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.Rain != nil {
-		e.rainDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.Rain)
+		e.setGauge(loc, "rain", e.rainDesc, float64(*respObj.CurrentWeather.Rain), precipitationUnit(loc), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.Showers != nil {
-		e.showersDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.Showers)
+		e.setGauge(loc, "showers", e.showersDesc, float64(*respObj.CurrentWeather.Showers), precipitationUnit(loc), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.Snowfall != nil {
-		e.snowfallDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.Snowfall)
+		e.setGauge(loc, "snowfall", e.snowfallDesc, float64(*respObj.CurrentWeather.Snowfall), snowfallUnit(loc), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.CloudCover != nil {
-		e.cloudCoverDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.CloudCover)
+		e.setGauge(loc, "cloud_cover", e.cloudCoverDesc, float64(*respObj.CurrentWeather.CloudCover), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.SurfacePressure != nil {
-		e.surfacePressureDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.SurfacePressure)
+		e.setGauge(loc, "surface_pressure", e.surfacePressureDesc, float64(*respObj.CurrentWeather.SurfacePressure), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.PressureMsl != nil {
-		e.pressureMslDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.PressureMsl)
+		e.setGauge(loc, "pressure_msl", e.pressureMslDesc, float64(*respObj.CurrentWeather.PressureMsl), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.WindSpeed != nil {
-		e.windSpeedDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.WindSpeed)
+		e.setGauge(loc, "wind_speed", e.windSpeedDesc, float64(*respObj.CurrentWeather.WindSpeed), "10m", windSpeedUnit(loc), loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.WindDirection != nil {
-		e.windDirDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.WindDirection)
+		e.setGauge(loc, "wind_dir", e.windDirDesc, float64(*respObj.CurrentWeather.WindDirection), "10m", loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.WindSpeed80m != nil {
+		e.setGauge(loc, "wind_speed", e.windSpeedDesc, float64(*respObj.CurrentWeather.WindSpeed80m), "80m", windSpeedUnit(loc), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.WindSpeed120m != nil {
+		e.setGauge(loc, "wind_speed", e.windSpeedDesc, float64(*respObj.CurrentWeather.WindSpeed120m), "120m", windSpeedUnit(loc), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.WindSpeed180m != nil {
+		e.setGauge(loc, "wind_speed", e.windSpeedDesc, float64(*respObj.CurrentWeather.WindSpeed180m), "180m", windSpeedUnit(loc), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.WindDirection80m != nil {
+		e.setGauge(loc, "wind_dir", e.windDirDesc, float64(*respObj.CurrentWeather.WindDirection80m), "80m", loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.WindDirection120m != nil {
+		e.setGauge(loc, "wind_dir", e.windDirDesc, float64(*respObj.CurrentWeather.WindDirection120m), "120m", loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.WindDirection180m != nil {
+		e.setGauge(loc, "wind_dir", e.windDirDesc, float64(*respObj.CurrentWeather.WindDirection180m), "180m", loc.Models, lat, lon)
 	}
 	if respObj.CurrentWeather.WindGusts != nil {
-		e.windGustsDesc.WithLabelValues(loc.Name).Set(*respObj.CurrentWeather.WindGusts)
+		e.setGauge(loc, "wind_gusts", e.windGustsDesc, float64(*respObj.CurrentWeather.WindGusts), windSpeedUnit(loc), loc.Models, lat, lon)
+	}
+	// gust factor is ratio of gust speed to mean wind speed
+	if respObj.CurrentWeather.WindGusts != nil && respObj.CurrentWeather.WindSpeed != nil && *respObj.CurrentWeather.WindSpeed != 0 {
+		e.setGauge(loc, "wind_gust_factor", e.windGustFactorDesc,
+			float64(*respObj.CurrentWeather.WindGusts)/float64(*respObj.CurrentWeather.WindSpeed), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.UvIndex != nil {
+		e.setGauge(loc, "uv_index", e.uvIndexDesc, float64(*respObj.CurrentWeather.UvIndex), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.Visibility != nil {
+		e.setGauge(loc, "visibility", e.visibilityDesc, float64(*respObj.CurrentWeather.Visibility), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.DewPoint != nil {
+		e.setGauge(loc, "dew_point", e.dewPointDesc, float64(*respObj.CurrentWeather.DewPoint), temperatureUnit(loc), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.IsDay != nil {
+		e.setGauge(loc, "is_day", e.isDayDesc, float64(*respObj.CurrentWeather.IsDay), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.WeatherCode != nil {
+		e.setGauge(loc, "weather_code", e.weatherCodeDesc, float64(*respObj.CurrentWeather.WeatherCode), loc.Models, lat, lon)
+		e.weatherCodeInfoDesc.DeletePartialMatch(prometheus.Labels{"location": loc.Name, "model": loc.Models})
+		lvs := append([]string{loc.Name, types.WeatherCodeDescription(int(*respObj.CurrentWeather.WeatherCode)), loc.Models, lat, lon},
+			e.staticLabelValues(loc)...)
+		e.weatherCodeInfoDesc.WithLabelValues(lvs...).Set(1)
+	}
+	if respObj.CurrentWeather.CloudCoverLow != nil {
+		e.setGauge(loc, "cloud_cover_low", e.cloudCoverLowDesc, float64(*respObj.CurrentWeather.CloudCoverLow), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.CloudCoverMid != nil {
+		e.setGauge(loc, "cloud_cover_mid", e.cloudCoverMidDesc, float64(*respObj.CurrentWeather.CloudCoverMid), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.CloudCoverHigh != nil {
+		e.setGauge(loc, "cloud_cover_high", e.cloudCoverHighDesc, float64(*respObj.CurrentWeather.CloudCoverHigh), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.SoilTemperature0cm != nil {
+		e.setGauge(loc, "soil_temperature", e.soilTemperatureDesc, float64(*respObj.CurrentWeather.SoilTemperature0cm), "0cm", temperatureUnit(loc), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.SoilTemperature6cm != nil {
+		e.setGauge(loc, "soil_temperature", e.soilTemperatureDesc, float64(*respObj.CurrentWeather.SoilTemperature6cm), "6cm", temperatureUnit(loc), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.SoilTemperature18cm != nil {
+		e.setGauge(loc, "soil_temperature", e.soilTemperatureDesc, float64(*respObj.CurrentWeather.SoilTemperature18cm), "18cm", temperatureUnit(loc), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.SoilTemperature54cm != nil {
+		e.setGauge(loc, "soil_temperature", e.soilTemperatureDesc, float64(*respObj.CurrentWeather.SoilTemperature54cm), "54cm", temperatureUnit(loc), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.SoilMoisture0To1cm != nil {
+		e.setGauge(loc, "soil_moisture", e.soilMoistureDesc, float64(*respObj.CurrentWeather.SoilMoisture0To1cm), "0-1cm", loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.SoilMoisture1To3cm != nil {
+		e.setGauge(loc, "soil_moisture", e.soilMoistureDesc, float64(*respObj.CurrentWeather.SoilMoisture1To3cm), "1-3cm", loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.SoilMoisture3To9cm != nil {
+		e.setGauge(loc, "soil_moisture", e.soilMoistureDesc, float64(*respObj.CurrentWeather.SoilMoisture3To9cm), "3-9cm", loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.SoilMoisture9To27cm != nil {
+		e.setGauge(loc, "soil_moisture", e.soilMoistureDesc, float64(*respObj.CurrentWeather.SoilMoisture9To27cm), "9-27cm", loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.SoilMoisture27To81cm != nil {
+		e.setGauge(loc, "soil_moisture", e.soilMoistureDesc, float64(*respObj.CurrentWeather.SoilMoisture27To81cm), "27-81cm", loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.Evapotranspiration != nil {
+		e.setGauge(loc, "evapotranspiration", e.evapotranspirationDesc, float64(*respObj.CurrentWeather.Evapotranspiration), loc.Models, lat, lon)
+	}
+	if respObj.CurrentWeather.VaporPressureDeficit != nil {
+		e.setGauge(loc, "vapor_pressure_deficit", e.vaporPressureDeficitDesc, float64(*respObj.CurrentWeather.VaporPressureDeficit), loc.Models, lat, lon)
+	}
+}
+
+func (e *exporter) handleDaily(ctx context.Context, loc types.Location) {
+	resp, err := e.fetch(ctx, loc, e.requestUri(loc), &types.ResponseDaily{})
+	if err != nil {
+		e.onError(loc, errorType(err), err)
+		return
+	}
+	respObj := resp.(*types.ResponseDaily)
+	e.setTimezone(loc, respObj.TimezoneInfo)
+	e.setGenerationTime(loc, respObj.GenerationInfo)
+	if respObj.Elevation != nil {
+		e.setGauge(loc, "elevation_meters", e.elevationDesc, *respObj.Elevation)
+	}
+	// first day of forecast is today, day label is offset from it
+	for i, v := range respObj.Daily.TemperatureMax {
+		if v != nil {
+			e.setGauge(loc, "temperature_max", e.dailyTempMaxDesc, float64(*v), strconv.Itoa(i), temperatureUnit(loc))
+		}
+	}
+	for i, v := range respObj.Daily.TemperatureMin {
+		if v != nil {
+			e.setGauge(loc, "temperature_min", e.dailyTempMinDesc, float64(*v), strconv.Itoa(i), temperatureUnit(loc))
+		}
+	}
+}
+
+// currentHourIndex returns index of current hour within hourly time array,
+// or -1 when current hour is not present.
+func currentHourIndex(times []string, utcOffsetSeconds *int) int {
+	now := time.Now()
+	// times are in UTC when API doesn't report offset
+	tz := time.UTC
+	if utcOffsetSeconds != nil {
+		tz = time.FixedZone("", *utcOffsetSeconds)
+	}
+	for i, ts := range times {
+		t, err := time.ParseInLocation("2006-01-02T15:04", ts, tz)
+		if err != nil {
+			continue
+		}
+		if !now.Before(t) && now.Before(t.Add(time.Hour)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *exporter) handleHourly(ctx context.Context, loc types.Location) {
+	hours := forecastHours(loc)
+	resp, err := e.fetch(ctx, loc, e.requestUri(loc), &types.ResponseHourly{})
+	if err != nil {
+		e.onError(loc, errorType(err), err)
+		return
+	}
+	respObj := resp.(*types.ResponseHourly)
+	e.setTimezone(loc, respObj.TimezoneInfo)
+	e.setGenerationTime(loc, respObj.GenerationInfo)
+	if respObj.Elevation != nil {
+		e.setGauge(loc, "elevation_meters", e.elevationDesc, *respObj.Elevation)
+	}
+	// response may come from cache, so first entry is not necessarily the current hour
+	start := currentHourIndex(respObj.Hourly.Time, respObj.TimezoneInfo.UtcOffsetSeconds)
+	if start < 0 {
+		e.locLogger(loc).Warn("Hourly forecast doesn't cover current hour")
+		return
+	}
+	for offset := 0; offset <= hours; offset++ {
+		i := start + offset
+		hour := strconv.Itoa(offset)
+		if i < len(respObj.Hourly.Temperature) && respObj.Hourly.Temperature[i] != nil {
+			e.setGauge(loc, "temperature", e.hourlyTempDesc, float64(*respObj.Hourly.Temperature[i]), hour, temperatureUnit(loc))
+		}
+		if i < len(respObj.Hourly.PrecipitationProbability) && respObj.Hourly.PrecipitationProbability[i] != nil {
+			e.setGauge(loc, "precipitation_probability", e.hourlyPrecipProbDesc,
+				float64(*respObj.Hourly.PrecipitationProbability[i]), hour)
+		}
+	}
+}
+
+func (e *exporter) handleAirQuality(ctx context.Context, loc types.Location) {
+	resp, err := e.fetch(ctx, loc, e.requestUri(loc), &types.ResponseAirQuality{})
+	if err != nil {
+		e.onError(loc, errorType(err), err)
+		return
+	}
+	respObj := resp.(*types.ResponseAirQuality)
+	e.setTimezone(loc, respObj.TimezoneInfo)
+	e.setGenerationTime(loc, respObj.GenerationInfo)
+	// not every index is available in every region
+	if respObj.Current.EuropeanAqi != nil {
+		e.setGauge(loc, "european_aqi", e.europeanAqiDesc, float64(*respObj.Current.EuropeanAqi))
+	}
+	if respObj.Current.UsAqi != nil {
+		e.setGauge(loc, "us_aqi", e.usAqiDesc, float64(*respObj.Current.UsAqi))
+	}
+}
+
+func (e *exporter) handleMarine(ctx context.Context, loc types.Location) {
+	resp, err := e.fetch(ctx, loc, e.requestUri(loc), &types.MarineResponse{})
+	if err != nil {
+		e.onError(loc, errorType(err), err)
+		return
+	}
+	respObj := resp.(*types.MarineResponse)
+	e.setTimezone(loc, respObj.TimezoneInfo)
+	e.setGenerationTime(loc, respObj.GenerationInfo)
+	if respObj.Current.WaveHeight != nil {
+		e.setGauge(loc, "wave_height", e.waveHeightDesc, float64(*respObj.Current.WaveHeight))
+	}
+	if respObj.Current.WaveDirection != nil {
+		e.setGauge(loc, "wave_direction", e.waveDirectionDesc, float64(*respObj.Current.WaveDirection))
+	}
+	if respObj.Current.WavePeriod != nil {
+		e.setGauge(loc, "wave_period", e.wavePeriodDesc, float64(*respObj.Current.WavePeriod))
+	}
+	if respObj.Current.SwellWaveHeight != nil {
+		e.setGauge(loc, "swell_wave_height", e.swellWaveHeightDesc, float64(*respObj.Current.SwellWaveHeight))
+	}
+	if respObj.Current.SwellWavePeriod != nil {
+		e.setGauge(loc, "swell_wave_period", e.swellWavePeriodDesc, float64(*respObj.Current.SwellWavePeriod))
+	}
+}
+
+func (e *exporter) handleFlood(ctx context.Context, loc types.Location) {
+	resp, err := e.fetch(ctx, loc, e.requestUri(loc), &types.FloodResponse{})
+	if err != nil {
+		e.onError(loc, errorType(err), err)
+		return
+	}
+	respObj := resp.(*types.FloodResponse)
+	e.setTimezone(loc, respObj.TimezoneInfo)
+	e.setGenerationTime(loc, respObj.GenerationInfo)
+	for i, v := range respObj.Daily.RiverDischarge {
+		if v != nil {
+			e.setGauge(loc, "river_discharge", e.riverDischargeDesc, float64(*v), strconv.Itoa(i))
+		}
 	}
 }
@@ -0,0 +1,1012 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+const currentWeatherJson = `{
+  "latitude": 48.14,
+  "longitude": 17.1,
+  "generationtime_ms": 0.05,
+  "utc_offset_seconds": 3600,
+  "timezone": "Europe/Bratislava",
+  "timezone_abbreviation": "CET",
+  "elevation": 140.0,
+  "current_weather": {"time": "2024-01-01T12:00", "temperature": 3.5, "windspeed": 12.0, "winddirection": 270.0}
+}`
+
+// upstream is fake API that counts requests for data of any location.
+type upstream struct {
+	*httptest.Server
+	requests atomic.Int32
+}
+
+func newUpstream(t *testing.T, handler http.HandlerFunc) *upstream {
+	u := &upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("latitude") {
+			u.requests.Add(1)
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func newTestExporter(t *testing.T, cfg *types.Config) *exporter {
+	e := NewExporter(cfg, time.Time{}, slog.New(slog.NewTextHandler(io.Discard, nil)), time.Second).(*exporter)
+	t.Cleanup(e.Stop)
+	return e
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// fakeApi makes exporter send its requests to handler instead of API.
+func fakeApi(e *exporter, handler http.HandlerFunc) {
+	e.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec.Result(), nil
+	})
+}
+
+// TestConcurrentScrapesAndStores is meant to be run with -race, it fails there if cache is accessed without lock.
+func TestConcurrentScrapesAndStores(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	method := types.FetchMethod(types.FetchMethodAlt)
+	locs := []types.Location{
+		{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}},
+		{Name: "Kosice", BaseURL: u.URL, FetchMethod: &method, Coordinates: types.Coordinates{Latitude: 48.72, Longitude: 21.26}},
+	}
+	e := newTestExporter(t, &types.Config{Locations: locs})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := reg.Gather(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				for _, loc := range locs {
+					// expire entry, so that next scrape fetches again and stores concurrently with readers
+					if entry, present := e.cached(loc); present {
+						entry.LastUpdate = time.Time{}
+						e.store(loc, entry)
+					}
+					_, _ = e.fetch(context.Background(), loc, e.requestUri(loc), newResponse(methodOf(loc)))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentFetchesShareRequest(t *testing.T) {
+	release := make(chan struct{})
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+	const n = 10
+	var wg sync.WaitGroup
+	results := make([]interface{}, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = e.fetch(context.Background(), loc, e.requestUri(loc), &types.Response{})
+		}(i)
+	}
+	// let all fetches join in-flight request before it completes
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := u.requests.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", got)
+	}
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatalf("fetch %d failed: %v", i, errs[i])
+		}
+		if results[i].(*types.Response).CurrentWeather.Temperature != 3.5 {
+			t.Fatalf("fetch %d got unexpected response: %+v", i, results[i])
+		}
+	}
+}
+
+func TestCanceledCallerDoesNotFailSharedFetch(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := e.fetch(ctx, loc, e.requestUri(loc), &types.Response{})
+		first <- err
+	}()
+	<-started
+	second := make(chan error, 1)
+	go func() {
+		_, err := e.fetch(context.Background(), loc, e.requestUri(loc), &types.Response{})
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-first; err == nil {
+		t.Fatal("expected canceled fetch to fail")
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Fatalf("expected shared fetch to succeed, got %v", err)
+	}
+	if got := u.requests.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", got)
+	}
+}
+
+// hourlyJson returns hourly forecast of 8 hours in timezone with given UTC offset, starting 2 hours before current hour.
+// Temperature of each hour equals its index.
+func hourlyJson(offsetSeconds int) string {
+	tz := time.FixedZone("", offsetSeconds)
+	start := time.Now().In(tz).Truncate(time.Hour).Add(-2 * time.Hour)
+	var times, temps []string
+	for i := 0; i < 8; i++ {
+		times = append(times, `"`+start.Add(time.Duration(i)*time.Hour).Format("2006-01-02T15:04")+`"`)
+		temps = append(temps, fmt.Sprintf("%d", i))
+	}
+	return fmt.Sprintf(`{
+  "latitude": 40.7,
+  "longitude": 74.0,
+  "utc_offset_seconds": %d,
+  "timezone": "Asia/Tashkent",
+  "timezone_abbreviation": "+05",
+  "hourly": {"time": [%s], "temperature_2m": [%s], "precipitation_probability": []}
+}`, offsetSeconds, strings.Join(times, ","), strings.Join(temps, ","))
+}
+
+func TestHourlyUsesReportedUtcOffset(t *testing.T) {
+	body := hourlyJson(5 * 3600)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	})
+	method := types.FetchMethod(types.FetchMethodHourly)
+	loc := types.Location{Name: "Tashkent", FetchMethod: &method, ForecastHours: 1, BaseURL: u.URL,
+		Coordinates: types.Coordinates{Latitude: 40.7, Longitude: 74.0}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+	e.handleHourly(context.Background(), loc)
+
+	expected := `
+# HELP openmeteo_hourly_temperature Hourly forecast of temperature at 2 meters above ground, hour is offset from current hour.
+# TYPE openmeteo_hourly_temperature gauge
+openmeteo_hourly_temperature{hour="0",location="Tashkent",unit="celsius"} 2
+openmeteo_hourly_temperature{hour="1",location="Tashkent",unit="celsius"} 3
+`
+	if err := testutil.CollectAndCompare(e.hourlyTempDesc, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHourlyForecastDays(t *testing.T) {
+	body := hourlyJson(5 * 3600)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("forecast_days") != "1" || r.URL.Query().Get("forecast_hours") != "3" {
+			t.Errorf("unexpected query: %s", r.URL.RawQuery)
+		}
+		_, _ = io.WriteString(w, body)
+	})
+	method := types.FetchMethod(types.FetchMethodHourly)
+	loc := types.Location{Name: "Tashkent", FetchMethod: &method, ForecastDays: 1, ForecastHours: 2, BaseURL: u.URL,
+		Coordinates: types.Coordinates{Latitude: 40.7, Longitude: 74.0}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+	if err := (&types.Config{Locations: []types.Location{loc}}).Validate(e.logger); err != nil {
+		t.Fatal(err)
+	}
+	e.handleHourly(context.Background(), loc)
+	if got := testutil.CollectAndCount(e.hourlyTempDesc); got == 0 {
+		t.Fatal("expected hourly forecast to be exported")
+	}
+}
+
+func TestDailyForecastDays(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("forecast_days") != "2" {
+			t.Errorf("unexpected forecast_days: %s", r.URL.Query().Get("forecast_days"))
+		}
+		_, _ = io.WriteString(w, `{"daily": {"time": ["2024-01-01", "2024-01-02"],
+			"temperature_2m_max": [5.5, 7.0], "temperature_2m_min": [-1.0, null]}}`)
+	})
+	method := types.FetchMethod(types.FetchMethodDaily)
+	loc := types.Location{Name: "Bratislava", FetchMethod: &method, ForecastDays: 2, BaseURL: u.URL,
+		Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+	e.handleDaily(context.Background(), loc)
+
+	expected := `
+# HELP openmeteo_daily_temperature_max Forecast of maximum daily temperature at 2 meters above ground, day is offset from today.
+# TYPE openmeteo_daily_temperature_max gauge
+openmeteo_daily_temperature_max{day="0",location="Bratislava",unit="celsius"} 5.5
+openmeteo_daily_temperature_max{day="1",location="Bratislava",unit="celsius"} 7
+# HELP openmeteo_daily_temperature_min Forecast of minimum daily temperature at 2 meters above ground, day is offset from today.
+# TYPE openmeteo_daily_temperature_min gauge
+openmeteo_daily_temperature_min{day="0",location="Bratislava",unit="celsius"} -1
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e.dailyTempMaxDesc, e.dailyTempMinDesc)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestQueryIsSortedByKey(t *testing.T) {
+	var query string
+	e := newTestExporter(t, &types.Config{})
+	fakeApi(e, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+
+	e.handleDefault(context.Background(), types.Location{Name: "Bratislava", Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}})
+
+	expected := "current_weather=true&latitude=48.14&longitude=17.10"
+	if query != expected {
+		t.Fatalf("unexpected query\nexpected: %s\n     got: %s", expected, query)
+	}
+}
+
+func TestCacheKeyPrefix(t *testing.T) {
+	loc := types.Location{Name: "Bratislava", Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	plain := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+	prefixed := newTestExporter(t, &types.Config{Locations: []types.Location{loc}, CacheKeyPrefix: "site-a/"})
+
+	key := plain.cacheKey(loc)
+	if !strings.HasPrefix(key, "48.14,17.10,default,") {
+		t.Fatalf("unexpected key without prefix: %s", key)
+	}
+	if got := prefixed.cacheKey(loc); got != "site-a/"+key {
+		t.Fatalf("expected key %s, got %s", "site-a/"+key, got)
+	}
+
+	prefixed.store(loc, types.CacheEntry{Response: &types.Response{}, LastUpdate: time.Now()})
+	if _, present := prefixed.root.cache["site-a/"+key]; !present {
+		t.Fatal("expected entry to be stored under prefixed key")
+	}
+}
+
+func TestSameCoordinatesShareCacheEntry(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	office := types.Location{Name: "Office", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	home := types.Location{Name: "Home", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{office, home}})
+
+	if e.cacheKey(office) != e.cacheKey(home) {
+		t.Fatalf("expected same cache key, got %s and %s", e.cacheKey(office), e.cacheKey(home))
+	}
+	e.handleDefault(context.Background(), office)
+	e.handleDefault(context.Background(), home)
+
+	if got := u.requests.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", got)
+	}
+	expected := `
+# HELP openmeteo_current_temperature The current temperature.
+# TYPE openmeteo_current_temperature gauge
+openmeteo_current_temperature{latitude="48.14",location="Home",longitude="17.10",model="",unit="celsius"} 3.5
+openmeteo_current_temperature{latitude="48.14",location="Office",longitude="17.10",model="",unit="celsius"} 3.5
+`
+	if err := testutil.CollectAndCompare(e.tempDesc, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStaticLabels(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	office := types.Location{Name: "Office", BaseURL: u.URL, Labels: map[string]string{"site": "office"},
+		Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	home := types.Location{Name: "Home", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{office, home}})
+
+	e.handleDefault(context.Background(), office)
+	e.handleDefault(context.Background(), home)
+
+	expected := `
+# HELP openmeteo_current_temperature The current temperature.
+# TYPE openmeteo_current_temperature gauge
+openmeteo_current_temperature{latitude="48.14",location="Home",longitude="17.10",model="",site="",unit="celsius"} 3.5
+openmeteo_current_temperature{latitude="48.14",location="Office",longitude="17.10",model="",site="office",unit="celsius"} 3.5
+`
+	if err := testutil.CollectAndCompare(e.tempDesc, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+	expected = `
+# HELP openmeteo_up Whether the last fetch of the location, either from API or from cache, succeeded.
+# TYPE openmeteo_up gauge
+openmeteo_up{location="Home",site=""} 1
+openmeteo_up{location="Office",site="office"} 1
+`
+	if err := testutil.CollectAndCompare(e.up, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestElevationGauge(t *testing.T) {
+	withElevation := types.Location{Name: "Bratislava", Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	without := types.Location{Name: "Vienna", Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{withElevation, without}})
+	fakeApi(e, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("latitude") == "48.14" {
+			_, _ = io.WriteString(w, currentWeatherJson)
+			return
+		}
+		_, _ = io.WriteString(w, `{"current_weather": {"time": "2024-01-01T12:00", "temperature": 1.0}}`)
+	})
+
+	e.handleDefault(context.Background(), withElevation)
+	e.handleDefault(context.Background(), without)
+
+	expected := `
+# HELP openmeteo_location_elevation_meters Elevation of the grid cell used for the location, as reported by API.
+# TYPE openmeteo_location_elevation_meters gauge
+openmeteo_location_elevation_meters{location="Bratislava"} 140
+`
+	if err := testutil.CollectAndCompare(e.elevationDesc, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStaleEntriesGauge(t *testing.T) {
+	fresh := types.Location{Name: "Bratislava", Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	expired := types.Location{Name: "Vienna", TtlMinutes: 5, Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}}
+	missing := types.Location{Name: "Budapest", Coordinates: types.Coordinates{Latitude: 47.5, Longitude: 19.04}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{fresh, expired, missing}})
+	fakeApi(e, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	e.store(fresh, types.CacheEntry{Response: &types.Response{}, LastUpdate: time.Now()})
+	e.store(expired, types.CacheEntry{Response: &types.Response{}, LastUpdate: time.Now().Add(-6 * time.Minute)})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+	expected := `
+# HELP openmeteo_exporter_stale_entries Number of cache entries which exceeded their TTL at the time of scrape.
+# TYPE openmeteo_exporter_stale_entries gauge
+openmeteo_exporter_stale_entries 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "openmeteo_exporter_stale_entries"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMixedPrecipitationUnits(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("precipitation_unit") == types.PrecipitationUnitInch {
+			_, _ = io.WriteString(w, `{"current": {"time": "2024-01-01T12:00", "precipitation": 0.05}}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"current": {"time": "2024-01-01T12:00", "precipitation": 1.2}}`)
+	})
+	method := types.FetchMethod(types.FetchMethodAlt)
+	metric := types.Location{Name: "Bratislava", FetchMethod: &method, BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	imperial := types.Location{Name: "New York", FetchMethod: &method, BaseURL: u.URL, PrecipitationUnit: types.PrecipitationUnitInch,
+		Coordinates: types.Coordinates{Latitude: 40.71, Longitude: -74.01}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{metric, imperial}})
+
+	e.handleAlt(context.Background(), metric)
+	e.handleAlt(context.Background(), imperial)
+
+	expected := `
+# HELP openmeteo_current_precipitation Probability of precipitation.
+# TYPE openmeteo_current_precipitation gauge
+openmeteo_current_precipitation{latitude="40.71",location="New York",longitude="-74.01",model="",unit="inch"} 0.05
+openmeteo_current_precipitation{latitude="48.14",location="Bratislava",longitude="17.10",model="",unit="mm"} 1.2
+`
+	if err := testutil.CollectAndCompare(e.precipitationDesc, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSoilTemperatureDepths(t *testing.T) {
+	method := types.FetchMethod(types.FetchMethodAlt)
+	loc := types.Location{Name: "Bratislava", FetchMethod: &method, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+	fakeApi(e, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"current": {"time": "2024-01-01T12:00", "soil_temperature_0cm": 4.5,
+  "soil_temperature_6cm": null, "soil_temperature_18cm": "6.25"}}`)
+	})
+
+	e.handleAlt(context.Background(), loc)
+
+	// 6cm is null and 54cm is missing altogether, neither is exported
+	expected := `
+# HELP openmeteo_current_soil_temperature Soil temperature at given depth below ground.
+# TYPE openmeteo_current_soil_temperature gauge
+openmeteo_current_soil_temperature{depth="0cm",latitude="48.14",location="Bratislava",longitude="17.10",model="",unit="celsius"} 4.5
+openmeteo_current_soil_temperature{depth="18cm",latitude="48.14",location="Bratislava",longitude="17.10",model="",unit="celsius"} 6.25
+`
+	if err := testutil.CollectAndCompare(e.soilTemperatureDesc, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDewPoint(t *testing.T) {
+	method := types.FetchMethod(types.FetchMethodAlt)
+	loc := types.Location{Name: "Bratislava", FetchMethod: &method, TemperatureUnit: types.TemperatureUnitFahrenheit,
+		Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+	fakeApi(e, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"current": {"time": "2024-01-01T12:00", "temperature_2m": 38.5, "dew_point_2m": 30.2}}`)
+	})
+
+	e.handleAlt(context.Background(), loc)
+
+	// dew point is reported in temperature unit of location
+	expected := `
+# HELP openmeteo_current_dew_point The dew point temperature at 2 meters above ground.
+# TYPE openmeteo_current_dew_point gauge
+openmeteo_current_dew_point{latitude="48.14",location="Bratislava",longitude="17.10",model="",unit="fahrenheit"} 30.2
+`
+	if err := testutil.CollectAndCompare(e.dewPointDesc, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNonFinitePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy      types.NonFinitePolicy
+		wantSeries  int
+		wantWarning bool
+	}{
+		{policy: "", wantSeries: 0},
+		{policy: types.NonFinitePolicySkip, wantSeries: 0},
+		{policy: types.NonFinitePolicyWarn, wantSeries: 0, wantWarning: true},
+		{policy: types.NonFinitePolicyKeep, wantSeries: 2},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			loc := types.Location{Name: "Bratislava"}
+			e := newTestExporter(t, &types.Config{NonFinitePolicy: tc.policy, Locations: []types.Location{loc}})
+			var out bytes.Buffer
+			e.logger = slog.New(slog.NewTextHandler(&out, nil))
+
+			e.setGauge(loc, "temperature", e.tempDesc, math.NaN(), "celsius", "", "48.14", "17.10")
+			e.setGauge(loc, "temperature", e.tempDesc, math.Inf(1), "fahrenheit", "", "48.14", "17.10")
+
+			if got := testutil.CollectAndCount(e.tempDesc); got != tc.wantSeries {
+				t.Errorf("expected %d series, got %d", tc.wantSeries, got)
+			}
+			if warned := strings.Contains(out.String(), "Skipping non-finite value"); warned != tc.wantWarning {
+				t.Errorf("expected warning: %v, log: %s", tc.wantWarning, out.String())
+			}
+		})
+	}
+}
+
+func TestImplausibleValues(t *testing.T) {
+	limit := 60.0
+	for _, tc := range []struct {
+		name       string
+		drop       bool
+		value      float64
+		wantSeries int
+		wantCount  float64
+	}{
+		{name: "plausible", value: 25, wantSeries: 1},
+		{name: "flagged", value: 75, wantSeries: 1, wantCount: 1},
+		{name: "dropped", drop: true, value: 75, wantCount: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loc := types.Location{Name: "Bratislava", Ranges: map[string]types.Range{
+				"temperature": {Max: &limit, Drop: tc.drop},
+			}}
+			e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+			e.setGauge(loc, "temperature", e.tempDesc, tc.value, "celsius", "", "48.14", "17.10")
+			// other metrics are not affected by range of temperature
+			e.setGauge(loc, "relative_humidity", e.relHumidityDesc, 75, "", "48.14", "17.10")
+
+			if got := testutil.CollectAndCount(e.tempDesc); got != tc.wantSeries {
+				t.Errorf("expected %d series, got %d", tc.wantSeries, got)
+			}
+			if got := testutil.CollectAndCount(e.relHumidityDesc); got != 1 {
+				t.Errorf("expected humidity to be exported, got %d series", got)
+			}
+			if got := testutil.ToFloat64(e.implausibleValues.WithLabelValues("Bratislava", "temperature")); got != tc.wantCount {
+				t.Errorf("expected %v implausible values, got %v", tc.wantCount, got)
+			}
+		})
+	}
+}
+
+// panickingResponse panics when decoded, like buggy decoder of unexpected response would.
+type panickingResponse struct{}
+
+func (*panickingResponse) UnmarshalJSON([]byte) error {
+	panic("unexpected response")
+}
+
+func TestPanicWhileFetchingIsReturnedAsError(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	broken := types.Location{Name: "Broken", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 1, Longitude: 1}}
+	healthy := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{broken, healthy}})
+
+	_, err := e.fetch(context.Background(), broken, e.requestUri(broken), &panickingResponse{})
+	if err == nil || !strings.Contains(err.Error(), "panic while fetching location Broken") {
+		t.Fatalf("expected panic to be returned as error, got %v", err)
+	}
+	if _, present := e.cached(broken); present {
+		t.Fatal("response which caused panic was cached")
+	}
+	resp, err := e.fetch(context.Background(), healthy, e.requestUri(healthy), &types.Response{})
+	if err != nil {
+		t.Fatalf("fetch of other location failed: %v", err)
+	}
+	if resp.(*types.Response).CurrentWeather.Temperature != 3.5 {
+		t.Fatalf("unexpected response of other location: %+v", resp)
+	}
+}
+
+func TestLastResponseBytes(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+	e.handleDefault(context.Background(), loc)
+	if got := testutil.ToFloat64(e.lastResponseBytes.WithLabelValues("Bratislava")); got != float64(len(currentWeatherJson)) {
+		t.Fatalf("expected %d bytes, got %v", len(currentWeatherJson), got)
+	}
+
+	// response served from cache doesn't change size of last response
+	e.lastResponseBytes.WithLabelValues("Bratislava").Set(0)
+	e.handleDefault(context.Background(), loc)
+	if got := testutil.ToFloat64(e.lastResponseBytes.WithLabelValues("Bratislava")); got != 0 {
+		t.Fatalf("expected cache hit to keep last response size, got %v", got)
+	}
+	if got := u.requests.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", got)
+	}
+}
+
+func TestAirQualityIndexes(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"current": {"time": "2024-01-01T12:00", "european_aqi": null, "us_aqi": 42}}`)
+	})
+	method := types.FetchMethod(types.FetchMethodAirQuality)
+	loc := types.Location{Name: "Denver", FetchMethod: &method, Coordinates: types.Coordinates{Latitude: 39.74, Longitude: -104.99}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+	// air quality API has fixed endpoint, so response is fetched from fake upstream first and handler serves it from cache
+	resp, err := e.fetch(context.Background(), loc, u.URL, &types.ResponseAirQuality{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.(*types.ResponseAirQuality).Current.UsAqi == nil {
+		t.Fatal("expected US AQI to be decoded")
+	}
+
+	e.handleAirQuality(context.Background(), loc)
+
+	expected := `
+# HELP openmeteo_air_quality_us_aqi United States air quality index.
+# TYPE openmeteo_air_quality_us_aqi gauge
+openmeteo_air_quality_us_aqi{location="Denver"} 42
+`
+	if err = testutil.CollectAndCompare(e.usAqiDesc, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(e.europeanAqiDesc); got != 0 {
+		t.Fatalf("expected no European AQI series, got %d", got)
+	}
+}
+
+func TestWindGustFactor(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		current    string
+		wantSeries int
+		want       float64
+	}{
+		{name: "gusts", current: `"wind_speed_10m": 10, "wind_gusts_10m": 25`, wantSeries: 1, want: 2.5},
+		{name: "calm", current: `"wind_speed_10m": 0, "wind_gusts_10m": 5`},
+		{name: "missing gusts", current: `"wind_speed_10m": 10`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, `{"current": {"time": "2024-01-01T12:00", `+tc.current+`}}`)
+			})
+			method := types.FetchMethod(types.FetchMethodAlt)
+			loc := types.Location{Name: "Bratislava", FetchMethod: &method, BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+			e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+			e.handleAlt(context.Background(), loc)
+
+			if got := testutil.CollectAndCount(e.windGustFactorDesc); got != tc.wantSeries {
+				t.Fatalf("expected %d series, got %d", tc.wantSeries, got)
+			}
+			if tc.wantSeries > 0 {
+				if got := testutil.ToFloat64(e.windGustFactorDesc.WithLabelValues("Bratislava", "", "48.14", "17.10")); got != tc.want {
+					t.Fatalf("expected gust factor %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCorrelationId(t *testing.T) {
+	var header string
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Correlation-ID")
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+	var out bytes.Buffer
+	e.logger = slog.New(slog.NewTextHandler(&out, nil))
+
+	e.handleDefault(context.Background(), loc)
+
+	id := correlationId("Bratislava")
+	if id != correlationId("Bratislava") || id == correlationId("Vienna") {
+		t.Fatalf("expected correlation ID to be stable and distinct per location")
+	}
+	if header != id {
+		t.Fatalf("expected correlation ID %s in request, got %q", id, header)
+	}
+	if !strings.Contains(out.String(), "location=Bratislava correlation_id="+id) {
+		t.Fatalf("expected error log to carry correlation ID %s, got: %s", id, out.String())
+	}
+}
+
+func TestTimezoneAbbreviation(t *testing.T) {
+	abbreviation := "CET"
+	var lock sync.Mutex
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		_, _ = io.WriteString(w, strings.Replace(currentWeatherJson, `"CET"`, `"`+abbreviation+`"`, 1))
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+	e.handleDefault(context.Background(), loc)
+	lock.Lock()
+	abbreviation = "CEST"
+	lock.Unlock()
+	e.handleDefault(withForceFetch(context.Background()), loc)
+
+	// series of previous abbreviation is replaced, e.g. on change of daylight saving time
+	expected := `
+# HELP openmeteo_location_timezone Timezone used by API for forecast times of the location, value is always 1.
+# TYPE openmeteo_location_timezone gauge
+openmeteo_location_timezone{abbreviation="CEST",location="Bratislava",timezone="Europe/Bratislava"} 1
+`
+	if err := testutil.CollectAndCompare(e.timezoneDesc, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	const backoff = 20 * time.Millisecond
+	for _, tc := range []struct {
+		name         string
+		status       int
+		wantRequests int
+		wantErr      bool
+	}{
+		// server fails twice, then succeeds
+		{name: "5xx is retried", status: http.StatusServiceUnavailable, wantRequests: 3},
+		{name: "4xx is not retried", status: http.StatusBadRequest, wantRequests: 1, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var lock sync.Mutex
+			var times []time.Time
+			u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				times = append(times, time.Now())
+				n := len(times)
+				lock.Unlock()
+				if n <= 2 {
+					w.WriteHeader(tc.status)
+					return
+				}
+				_, _ = io.WriteString(w, currentWeatherJson)
+			})
+			loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+			e := newTestExporter(t, &types.Config{MaxRetries: 3, RetryBackoff: backoff, Locations: []types.Location{loc}})
+
+			_, _, err := e.get(context.Background(), e.requestUri(loc), correlationId(loc.Name), nil)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error: %v, got %v", tc.wantErr, err)
+			}
+			if got := int(u.requests.Load()); got != tc.wantRequests {
+				t.Fatalf("expected %d requests, got %d", tc.wantRequests, got)
+			}
+			// jittered delay before retry attempt n is at least half of backoff doubled n times
+			for i := 1; i < len(times); i++ {
+				if gap, least := times[i].Sub(times[i-1]), (backoff<<(i-1))/2; gap < least {
+					t.Fatalf("retry %d came after %v, expected at least %v", i, gap, least)
+				}
+			}
+		})
+	}
+}
+
+func TestLastSuccessTimestamp(t *testing.T) {
+	var failing atomic.Bool
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, TtlMinutes: 5, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+	lastSuccess := func() float64 {
+		return testutil.ToFloat64(e.lastSuccess.WithLabelValues(loc.Name))
+	}
+	// expire cached entry, so that next fetch goes to API
+	expire := func() {
+		entry, _ := e.cached(loc)
+		entry.LastUpdate = entry.LastUpdate.Add(-10 * time.Minute)
+		e.store(loc, entry)
+	}
+
+	if _, err := e.fetch(context.Background(), loc, e.requestUri(loc), &types.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	first := lastSuccess()
+	if first == 0 {
+		t.Fatal("expected last success to be set after successful fetch")
+	}
+
+	expire()
+	failing.Store(true)
+	if _, err := e.fetch(context.Background(), loc, e.requestUri(loc), &types.Response{}); err == nil {
+		t.Fatal("expected fetch to fail")
+	}
+	if got := lastSuccess(); got != first {
+		t.Fatalf("expected last success to stay at %v after failure, got %v", first, got)
+	}
+
+	failing.Store(false)
+	if _, err := e.fetch(context.Background(), loc, e.requestUri(loc), &types.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := e.cached(loc)
+	if got := lastSuccess(); got != float64(entry.LastUpdate.Unix()) || got < first {
+		t.Fatalf("expected last success to advance to %v, got %v", entry.LastUpdate.Unix(), got)
+	}
+}
+
+func TestHttpResponsesByStatusCode(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("latitude") == "48.14" {
+			_, _ = io.WriteString(w, currentWeatherJson)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	ok := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	failing := types.Location{Name: "Vienna", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{ok, failing}})
+
+	e.handleDefault(context.Background(), ok)
+	e.handleDefault(context.Background(), failing)
+	e.handleDefault(withForceFetch(context.Background()), failing)
+
+	host := u.Listener.Addr().String()
+	expected := fmt.Sprintf(`
+# HELP openmeteo_exporter_http_responses_total Total number of HTTP responses received from API, by host and status code.
+# TYPE openmeteo_exporter_http_responses_total counter
+openmeteo_exporter_http_responses_total{code="200",host="%[1]s"} 1
+openmeteo_exporter_http_responses_total{code="500",host="%[1]s"} 2
+`, host)
+	if err := testutil.CollectAndCompare(e.httpResponses, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConditionalRequestOnlyWithCachedEntry(t *testing.T) {
+	var lock sync.Mutex
+	var conditional []bool
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		conditional = append(conditional, r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "")
+		lock.Unlock()
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+
+	if _, err := e.fetch(context.Background(), loc, e.requestUri(loc), &types.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := e.cached(loc)
+	if entry.ETag != `"v1"` {
+		t.Fatalf("expected ETag of response to be cached, got %q", entry.ETag)
+	}
+	if got := testutil.ToFloat64(e.notModified); got != 0 {
+		t.Fatalf("expected no not-modified response without cached entry, got %v", got)
+	}
+	resp, err := e.fetch(withForceFetch(context.Background()), loc, e.requestUri(loc), &types.Response{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != entry.Response {
+		t.Fatal("expected cached response to be reused when not modified")
+	}
+	if got := testutil.ToFloat64(e.notModified); got != 1 {
+		t.Fatalf("expected not-modified response to be counted, got %v", got)
+	}
+	if !slices.Equal(conditional, []bool{false, true}) {
+		t.Fatalf("expected only request with cached entry to be conditional, got %v", conditional)
+	}
+}
+
+func TestLocationTimeoutOverridesGlobal(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		locationTimeout int
+		httpTimeout     time.Duration
+	}{
+		// global timeout alone would let request run for 5 seconds
+		{name: "shorter than global", locationTimeout: 1, httpTimeout: 5 * time.Second},
+		// every attempt is still capped by global timeout, location timeout only bounds retries
+		{name: "longer than global", locationTimeout: 3, httpTimeout: time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			canceled := make(chan struct{}, 1)
+			u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+					canceled <- struct{}{}
+				case <-time.After(10 * time.Second):
+					_, _ = io.WriteString(w, currentWeatherJson)
+				}
+			})
+			loc := types.Location{Name: "Bratislava", BaseURL: u.URL, TimeoutSeconds: tc.locationTimeout,
+				Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+			e := NewExporter(&types.Config{Locations: []types.Location{loc}}, time.Time{}, slog.New(slog.NewTextHandler(io.Discard, nil)), tc.httpTimeout).(*exporter)
+			t.Cleanup(e.Stop)
+
+			start := time.Now()
+			_, err := e.fetch(context.Background(), loc, e.requestUri(loc), &types.Response{})
+			if elapsed := time.Since(start); elapsed < time.Second || elapsed > 2*time.Second {
+				t.Fatalf("expected fetch to be aborted after 1s, took %v", elapsed)
+			}
+			if errorType(err) != errorTypeTimeout {
+				t.Fatalf("expected timeout error, got %v", err)
+			}
+			select {
+			case <-canceled:
+			case <-time.After(time.Second):
+				t.Fatal("request to slow upstream wasn't canceled")
+			}
+		})
+	}
+}
+
+func TestApiKey(t *testing.T) {
+	methods := []types.FetchMethod{types.FetchMethodDefault, types.FetchMethodAlt, types.FetchMethodDaily,
+		types.FetchMethodHourly, types.FetchMethodAirQuality, types.FetchMethodMarine, types.FetchMethodFlood}
+	for _, method := range methods {
+		t.Run(string(method), func(t *testing.T) {
+			loc := types.Location{Name: "Bratislava", FetchMethod: &method, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+
+			public, err := url.Parse(newTestExporter(t, &types.Config{}).requestUri(loc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if public.Query().Has("apikey") || strings.HasPrefix(public.Host, "customer-") {
+				t.Fatalf("expected public endpoint without key, got %s", public)
+			}
+
+			commercial, err := url.Parse(newTestExporter(t, &types.Config{APIKey: "secret"}).requestUri(loc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commercial.Query().Get("apikey") != "secret" || commercial.Host != "customer-"+public.Host {
+				t.Fatalf("expected customer endpoint of %s with key, got %s", public.Host, commercial)
+			}
+		})
+	}
+}
+
+func TestRedactErrRemovesApiKey(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		uri  string
+	}{
+		{name: "failed request", uri: "http://127.0.0.1:1/v1/forecast?apikey=secret&latitude=48.14"},
+		{name: "malformed base URL", uri: "http://[::1/v1/forecast?apikey=secret&latitude=48.14"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestExporter(t, &types.Config{})
+			_, _, err := e.getOnce(context.Background(), tc.uri, "", nil)
+			var ue *url.Error
+			if !errors.As(err, &ue) {
+				t.Fatalf("expected *url.Error, got %v", err)
+			}
+			if strings.Contains(err.Error(), "secret") || !strings.Contains(err.Error(), "apikey=REDACTED") {
+				t.Fatalf("expected API key to be redacted: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+const influxMeasurement = "openmeteo_current"
+
+var (
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+)
+
+// influxFields extracts current weather readings from cached response as field name/value pairs,
+// names are taken from JSON names of API. Non-finite values are left out, line protocol can't represent them.
+func influxFields(resp interface{}) map[string]float64 {
+	var cw reflect.Value
+	switch r := resp.(type) {
+	case *types.Response:
+		cw = reflect.ValueOf(r.CurrentWeather)
+	case *types.ResponseAlt:
+		cw = reflect.ValueOf(r.CurrentWeather)
+	default:
+		return nil
+	}
+	fields := map[string]float64{}
+	for i := 0; i < cw.NumField(); i++ {
+		name, _, _ := strings.Cut(cw.Type().Field(i).Tag.Get("json"), ",")
+		if name == "" {
+			name = strings.ToLower(cw.Type().Field(i).Name)
+		}
+		var v float64
+		switch f := cw.Field(i).Interface().(type) {
+		case float64:
+			v = f
+		case *types.Number:
+			if f == nil {
+				continue
+			}
+			v = float64(*f)
+		default:
+			continue
+		}
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			fields[name] = v
+		}
+	}
+	return fields
+}
+
+// influxLine formats current weather of location as single line of InfluxDB line protocol.
+func (e *exporter) influxLine(loc types.Location, entry types.CacheEntry) string {
+	fields := influxFields(entry.Response)
+	if len(fields) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString(influxMeasurementEscaper.Replace(influxMeasurement))
+	tags := map[string]string{"location": loc.Name, "model": loc.Models}
+	for k, v := range loc.Labels {
+		tags[k] = v
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		// empty tag values are not allowed
+		if tags[k] == "" {
+			continue
+		}
+		sb.WriteString("," + influxTagEscaper.Replace(k) + "=" + influxTagEscaper.Replace(tags[k]))
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for i, name := range names {
+		if i == 0 {
+			sb.WriteString(" ")
+		} else {
+			sb.WriteString(",")
+		}
+		sb.WriteString(influxTagEscaper.Replace(name) + "=" + strconv.FormatFloat(fields[name], 'f', -1, 64))
+	}
+	sb.WriteString(" " + strconv.FormatInt(entry.LastUpdate.Unix(), 10))
+	return sb.String()
+}
+
+// influxWriteUri returns URL of InfluxDB v2 write endpoint.
+func (e *exporter) influxWriteUri() (string, error) {
+	u, err := url.Parse(e.cfg().InfluxURL)
+	if err != nil {
+		return "", err
+	}
+	u = u.JoinPath("api", "v2", "write")
+	params := url.Values{}
+	params.Set("org", e.cfg().InfluxOrg)
+	params.Set("bucket", e.cfg().InfluxBucket)
+	params.Set("precision", "s")
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// pushInflux writes cached current weather of location to InfluxDB, if configured.
+// Failures are logged and counted, they never affect Prometheus metrics of location.
+func (e *exporter) pushInflux(ctx context.Context, loc types.Location) {
+	if e.cfg().InfluxURL == "" {
+		return
+	}
+	entry, present := e.cached(loc)
+	if !present {
+		return
+	}
+	line := e.influxLine(loc, entry)
+	if line == "" {
+		return
+	}
+	if err := e.writeInflux(ctx, line); err != nil {
+		e.influxErrors.Inc()
+		e.locLogger(loc).Warn("Couldn't push data to InfluxDB", "error", err)
+	}
+}
+
+func (e *exporter) writeInflux(ctx context.Context, body string) error {
+	uri, err := e.influxWriteUri()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.httpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewBufferString(body+"\n"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.cfg().InfluxToken != "" {
+		req.Header.Set("Authorization", "Token "+e.cfg().InfluxToken)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
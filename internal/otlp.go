@@ -0,0 +1,142 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/rkosegi/open-meteo-exporter/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/grpc/credentials"
+)
+
+const otlpScope = "openmeteo_exporter"
+
+// newOTLPExporter creates exporter pushing to OTLP/gRPC receiver. Connection is established lazily.
+// Endpoint with https scheme uses TLS, honoring CA file and insecure_skip_verify of configuration.
+func (e *exporter) newOTLPExporter(ctx context.Context, cfg *types.OTLPConfig) (*otlpmetricgrpc.Exporter, error) {
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpointURL(cfg.Endpoint),
+		otlpmetricgrpc.WithHeaders(cfg.Headers),
+	}
+	if u, err := url.Parse(cfg.Endpoint); err == nil && u.Scheme == "https" {
+		if tc := e.tlsConfig(); tc != nil {
+			opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tc)))
+		}
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// otlpMetrics converts weather gauges of all locations to OTLP gauges, labels of series become attributes of data points.
+// Non-finite values are left out.
+func (e *exporter) otlpMetrics(now time.Time) (*metricdata.ResourceMetrics, error) {
+	mfs, err := e.weatherRegistry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var metrics []metricdata.Metrics
+	for _, mf := range mfs {
+		var dps []metricdata.DataPoint[float64]
+		for _, pb := range mf.GetMetric() {
+			v := pb.GetGauge().GetValue()
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			var attrs []attribute.KeyValue
+			for _, lp := range pb.GetLabel() {
+				attrs = append(attrs, attribute.String(lp.GetName(), lp.GetValue()))
+			}
+			dps = append(dps, metricdata.DataPoint[float64]{Attributes: attribute.NewSet(attrs...), Time: now, Value: v})
+		}
+		if len(dps) > 0 {
+			metrics = append(metrics, metricdata.Metrics{
+				Name:        mf.GetName(),
+				Description: mf.GetHelp(),
+				Data:        metricdata.Gauge[float64]{DataPoints: dps},
+			})
+		}
+	}
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+	return &metricdata.ResourceMetrics{
+		Resource: resource.NewSchemaless(attribute.String("service.name", otlpScope)),
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: otlpScope},
+			Metrics: metrics,
+		}},
+	}, nil
+}
+
+// otlpInterval returns interval between pushes to OTLP receiver.
+func (e *exporter) otlpInterval() time.Duration {
+	if d := e.cfg().OTLP.Interval; d > 0 {
+		return d
+	}
+	return time.Minute
+}
+
+// runOTLP pushes metrics of all locations to OTLP receiver every interval, until ctx is done.
+func (e *exporter) runOTLP(ctx context.Context, otlp *otlpmetricgrpc.Exporter) {
+	defer e.schedWg.Done()
+	ticker := time.NewTicker(e.otlpInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.pushOTLP(ctx, otlp)
+		}
+	}
+}
+
+// pushOTLP sends current values of weather gauges of all locations to OTLP receiver in single batch.
+// Failures are logged and counted, they never affect Prometheus metrics.
+func (e *exporter) pushOTLP(ctx context.Context, otlp *otlpmetricgrpc.Exporter) {
+	rm, err := e.otlpMetrics(time.Now())
+	if err == nil && rm != nil {
+		ctx, cancel := context.WithTimeout(ctx, e.httpTimeout)
+		defer cancel()
+		err = otlp.Export(ctx, rm)
+	}
+	if err != nil {
+		e.otlpErrors.Inc()
+		e.logger.Warn("Couldn't push metrics to OTLP endpoint", "endpoint", e.cfg().OTLP.Endpoint, "error", err)
+	}
+}
+
+// stopOTLP shuts down OTLP exporter, it must not be called while refreshes are running.
+func (e *exporter) stopOTLP() {
+	if e.otlp == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.otlp.Shutdown(ctx); err != nil {
+		e.logger.Warn("Couldn't shut down OTLP exporter", "error", err)
+	}
+	e.otlp = nil
+}
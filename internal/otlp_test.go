@@ -0,0 +1,152 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rkosegi/open-meteo-exporter/types"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// receiver is fake OTLP/gRPC receiver which forwards every export to requests.
+type receiver struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	requests chan *colmetricpb.ExportMetricsServiceRequest
+	headers  chan metadata.MD
+}
+
+func (r *receiver) Export(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.headers <- md
+	r.requests <- req
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func newReceiver(t *testing.T) (*receiver, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &receiver{
+		requests: make(chan *colmetricpb.ExportMetricsServiceRequest, 10),
+		headers:  make(chan metadata.MD, 10),
+	}
+	srv := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(srv, r)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+	return r, "http://" + lis.Addr().String()
+}
+
+func gauges(req *colmetricpb.ExportMetricsServiceRequest) map[string][]*metricpb.NumberDataPoint {
+	res := map[string][]*metricpb.NumberDataPoint{}
+	for _, rm := range req.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				res[m.GetName()] = append(res[m.GetName()], m.GetGauge().GetDataPoints()...)
+			}
+		}
+	}
+	return res
+}
+
+func TestOTLPPushEveryInterval(t *testing.T) {
+	recv, endpoint := newReceiver(t)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	newTestExporter(t, &types.Config{
+		Locations:         []types.Location{loc},
+		BackgroundRefresh: true,
+		OTLP: &types.OTLPConfig{
+			Endpoint: endpoint,
+			Headers:  map[string]string{"Authorization": "Bearer secret"},
+			Interval: 50 * time.Millisecond,
+		},
+	}).Start()
+
+	var req *colmetricpb.ExportMetricsServiceRequest
+	select {
+	case req = <-recv.requests:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no metrics were pushed")
+	}
+	if md := <-recv.headers; len(md.Get("authorization")) != 1 || md.Get("authorization")[0] != "Bearer secret" {
+		t.Errorf("expected configured headers to be sent, got %v", md)
+	}
+	dps := gauges(req)["openmeteo_current_temperature"]
+	if len(dps) != 1 {
+		t.Fatalf("expected single temperature data point, got %v", dps)
+	}
+	if dps[0].GetAsDouble() != 3.5 {
+		t.Errorf("expected temperature 3.5, got %v", dps[0].GetAsDouble())
+	}
+	attrs := map[string]string{}
+	for _, kv := range dps[0].GetAttributes() {
+		attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	if attrs["location"] != "Bratislava" || attrs["unit"] != "celsius" {
+		t.Errorf("expected labels to become attributes, got %v", attrs)
+	}
+}
+
+func TestOTLPMetricsOfAllLocations(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	ba := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	vi := types.Location{Name: "Vienna", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{ba, vi}})
+	e.handleDefault(context.Background(), ba)
+	e.handleDefault(context.Background(), vi)
+
+	rm, err := e.otlpMetrics(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "openmeteo_current_temperature" {
+				continue
+			}
+			locations := map[string]bool{}
+			for _, dp := range m.Data.(metricdata.Gauge[float64]).DataPoints {
+				v, _ := dp.Attributes.Value("location")
+				locations[v.AsString()] = true
+			}
+			if len(locations) != 2 || !locations["Bratislava"] || !locations["Vienna"] {
+				t.Fatalf("expected data points of both locations in single batch, got %v", locations)
+			}
+			return
+		}
+	}
+	t.Fatal("expected temperature metric")
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// writeCacheFile writes serialized cache to file, optionally gzip-compressed.
+// Data are written to temporary file first, which is then renamed, so that file is never left half-written.
+func writeCacheFile(path string, data []byte, compress bool) error {
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readCacheFile reads serialized cache from file. Compressed file is detected and decompressed transparently,
+// so that compression can be turned on or off without losing existing cache.
+func readCacheFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+	return io.ReadAll(zr)
+}
+
+// persistedEntry is serialized form of cache entry. Method is needed to decode response into correct type.
+type persistedEntry struct {
+	Method     types.FetchMethod `json:"method"`
+	LastUpdate time.Time         `json:"last_update"`
+	Response   json.RawMessage   `json:"response"`
+	// validators of response, see types.CacheEntry
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// newResponse returns empty response object for fetch method.
+func newResponse(method types.FetchMethod) interface{} {
+	switch method {
+	case types.FetchMethodAlt:
+		return &types.ResponseAlt{}
+	case types.FetchMethodDaily:
+		return &types.ResponseDaily{}
+	case types.FetchMethodHourly:
+		return &types.ResponseHourly{}
+	case types.FetchMethodAirQuality:
+		return &types.ResponseAirQuality{}
+	case types.FetchMethodMarine:
+		return &types.MarineResponse{}
+	case types.FetchMethodFlood:
+		return &types.FloodResponse{}
+	default:
+		return &types.Response{}
+	}
+}
+
+// saveCache writes cached responses of configured locations to cache file.
+func (e *exporter) saveCache() error {
+	entries := map[string]persistedEntry{}
+	e.cacheLock.RLock()
+	for _, loc := range e.cfg().Locations {
+		key := e.cacheKey(loc)
+		entry, present := e.cache[key]
+		if !present {
+			continue
+		}
+		data, err := json.Marshal(entry.Response)
+		if err != nil {
+			e.locLogger(loc).Warn("Couldn't serialize cached response", "error", err)
+			continue
+		}
+		entries[key] = persistedEntry{
+			Method:     methodOf(loc),
+			LastUpdate: entry.LastUpdate,
+			Response:   data,
+
+			ETag:         entry.ETag,
+			LastModified: entry.LastModified,
+		}
+	}
+	e.cacheLock.RUnlock()
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err = writeCacheFile(e.cfg().CachePath, data, e.cfg().CacheCompress); err != nil {
+		return err
+	}
+	e.logger.Info("Saved cache to disk", "path", e.cfg().CachePath, "entries", len(entries))
+	return nil
+}
+
+// loadCache loads cached responses from cache file, entries older than TTL of their location are dropped.
+// Missing file is not an error, it's expected on first start.
+func (e *exporter) loadCache() error {
+	data, err := readCacheFile(e.cfg().CachePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries map[string]persistedEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	loaded := 0
+	e.cacheLock.Lock()
+	defer e.cacheLock.Unlock()
+	for _, loc := range e.cfg().Locations {
+		key := e.cacheKey(loc)
+		pe, present := entries[key]
+		if !present || pe.Method != methodOf(loc) || time.Since(pe.LastUpdate) >= e.ttl(loc) {
+			continue
+		}
+		resp := newResponse(pe.Method)
+		if err = json.Unmarshal(pe.Response, resp); err != nil {
+			e.locLogger(loc).Warn("Couldn't deserialize cached response", "error", err)
+			continue
+		}
+		e.cache[key] = types.CacheEntry{
+			Response:   resp,
+			LastUpdate: pe.LastUpdate,
+
+			ETag:         pe.ETag,
+			LastModified: pe.LastModified,
+		}
+		loaded++
+	}
+	e.logger.Info("Loaded cache from disk", "path", e.cfg().CachePath, "entries", loaded)
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+func TestCacheFileRoundTrip(t *testing.T) {
+	data := []byte(`{"48.14,17.10,default":{"method":"default","last_update":"2024-01-01T12:00:00Z","response":{}}}`)
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			if err := writeCacheFile(path, data, compress); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.HasPrefix(raw, gzipMagic) != compress {
+				t.Fatalf("expected compressed file: %v, got %q", compress, raw[:2])
+			}
+
+			// compression is detected on read, so toggled option doesn't lose cache
+			got, err := readCacheFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("data didn't survive round-trip, got %s", got)
+			}
+		})
+	}
+}
+
+func TestCacheSurvivesRestart(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	fresh := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	expired := types.Location{Name: "Vienna", BaseURL: u.URL, TtlMinutes: 5, Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}}
+	cfg := &types.Config{CachePath: filepath.Join(t.TempDir(), "cache.json"), Locations: []types.Location{fresh, expired}}
+
+	e := newTestExporter(t, cfg)
+	e.handleDefault(context.Background(), fresh)
+	e.handleDefault(context.Background(), expired)
+	entry, _ := e.cached(expired)
+	entry.LastUpdate = time.Now().Add(-6 * time.Minute)
+	e.store(expired, entry)
+	e.Stop()
+
+	requests := u.requests.Load()
+	restored := newTestExporter(t, cfg)
+	if _, present := restored.cached(expired); present {
+		t.Fatal("entry older than TTL of its location wasn't dropped on load")
+	}
+	restored.handleDefault(context.Background(), fresh)
+	if got := u.requests.Load(); got != requests {
+		t.Fatalf("expected restored entry to be served from cache, got %d upstream requests", got-requests)
+	}
+	if got := testutil.ToFloat64(restored.tempDesc.WithLabelValues("Bratislava", "celsius", "", "48.14", "17.10")); got != 3.5 {
+		t.Fatalf("expected temperature 3.5 from restored cache, got %v", got)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+// newProbe returns exporter of single location, which has its own metrics, but shares cache (see cached and store),
+// rate limiting state and HTTP client with e. Probe doesn't run any background activities.
+// Counters which aren't specific to location are shared with e, so that activity of probes is accounted there.
+func (e *exporter) newProbe(loc types.Location) *exporter {
+	cfg := *e.cfg()
+	cfg.Locations = []types.Location{loc}
+	cfg.Batch = false
+	cfg.BackgroundRefresh = false
+	p := &exporter{
+		logger: e.logger.With("probe", loc.Name),
+		root:   e.root,
+		status: map[string]*locationStatus{},
+		ctx:    e.ctx,
+		cancel: func() {},
+
+		httpTimeout: e.httpTimeout,
+	}
+	p.config.Store(&cfg)
+	p.init()
+	p.totalScrapes = e.root.totalScrapes
+	p.rateLimited = e.root.rateLimited
+	p.notModified = e.root.notModified
+	p.configMtime = e.root.configMtime
+	p.apiErrors = e.root.apiErrors
+	p.httpDuration = e.root.httpDuration
+	p.httpResponses = e.root.httpResponses
+	p.httpTraffic = e.root.httpTraffic
+	p.client = e.root.client
+	p.requestTimeout.Set(p.client.Timeout.Seconds())
+	p.metricFamilies.Set(float64(p.countMetricFamilies()))
+	p.concurrency.Set(float64(p.maxConcurrency()))
+	return p
+}
+
+// ProbeHandler serves metrics of location given by "latitude", "longitude" and optionally "method"
+// and "name" query parameters, so that targets can be supplied by Prometheus via relabeling.
+func (e *exporter) ProbeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		lat, err := strconv.ParseFloat(q.Get("latitude"), 64)
+		if err != nil || !types.ValidLatitude(lat) {
+			http.Error(w, "Invalid or missing latitude", http.StatusBadRequest)
+			return
+		}
+		lon, err := strconv.ParseFloat(q.Get("longitude"), 64)
+		if err != nil || !types.ValidLongitude(lon) {
+			http.Error(w, "Invalid or missing longitude", http.StatusBadRequest)
+			return
+		}
+		loc := types.Location{
+			Name: q.Get("name"),
+			Coordinates: types.Coordinates{
+				Latitude:  lat,
+				Longitude: lon,
+			},
+		}
+		if loc.Name == "" {
+			loc.Name = q.Get("latitude") + "," + q.Get("longitude")
+		}
+		if m := q.Get("method"); m != "" {
+			method := types.FetchMethod(m)
+			if !method.Valid() {
+				http.Error(w, "Unknown method", http.StatusBadRequest)
+				return
+			}
+			loc.FetchMethod = &method
+		}
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(e.newProbe(loc).WithContext(r.Context()))
+		promhttp.HandlerFor(gaugesOnly{reg}, promhttp.HandlerOpts{
+			ErrorHandling: promhttp.ContinueOnError,
+		}).ServeHTTP(w, r)
+	})
+}
+
+// gaugesOnly is gatherer which leaves out counters, histograms and summaries. Probe is created for every request,
+// so its cumulative metrics would start from zero every time, which breaks rate().
+type gaugesOnly struct {
+	prometheus.Gatherer
+}
+
+func (g gaugesOnly) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	gauges := mfs[:0]
+	for _, mf := range mfs {
+		if t := mf.GetType(); t == dto.MetricType_GAUGE || t == dto.MetricType_UNTYPED {
+			gauges = append(gauges, mf)
+		}
+	}
+	return gauges, err
+}
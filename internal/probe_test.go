@@ -0,0 +1,152 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+// probe requests metrics of location at given coordinates from probe handler of e and returns response body.
+func probe(t *testing.T, e *exporter, lat, lon float64) string {
+	srv := httptest.NewServer(e.ProbeHandler())
+	defer srv.Close()
+	resp, err := http.Get(fmt.Sprintf("%s/probe?latitude=%v&longitude=%v", srv.URL, lat, lon))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("probe failed with status %d: %s", resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+func TestProbeExportsExporterGauges(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	e := newTestExporter(t, &types.Config{BaseURL: u.URL, MaxConcurrency: 2})
+
+	body := probe(t, e, 48.14, 17.1)
+
+	for _, line := range []string{
+		fmt.Sprintf("openmeteo_exporter_metric_families %d\n", int(testutil.ToFloat64(e.metricFamilies))),
+		"openmeteo_exporter_configured_concurrency 2\n",
+		`openmeteo_current_temperature{latitude="48.14",location="48.14,17.1",longitude="17.10",model="",unit="celsius"} 3.5` + "\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("probe output doesn't contain %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestProbeLeavesOutCounters(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	e := newTestExporter(t, &types.Config{BaseURL: u.URL})
+
+	for i := 0; i < 2; i++ {
+		body := probe(t, e, 48.14, 17.1)
+		for _, name := range []string{"openmeteo_exporter_total_scrapes", "openmeteo_exporter_http_responses_total", "openmeteo_exporter_cache_miss"} {
+			if strings.Contains(body, name) {
+				t.Errorf("probe output contains counter %s:\n%s", name, body)
+			}
+		}
+	}
+	// probes are accounted by counters of exporter
+	if got := testutil.ToFloat64(e.totalScrapes); got != 2 {
+		t.Fatalf("expected 2 scrapes, got %v", got)
+	}
+	if got := testutil.ToFloat64(e.httpResponses.WithLabelValues(strings.TrimPrefix(u.URL, "http://"), "200")); got != 1 {
+		t.Fatalf("expected 1 response, got %v", got)
+	}
+}
+
+func TestProbeRejectsInvalidCoordinates(t *testing.T) {
+	e := newTestExporter(t, &types.Config{})
+	srv := httptest.NewServer(e.ProbeHandler())
+	defer srv.Close()
+	for _, query := range []string{
+		"latitude=NaN&longitude=17.1",
+		"latitude=48.14&longitude=NaN",
+		"latitude=91&longitude=17.1",
+		"latitude=48.14&longitude=-180.5",
+		"latitude=48.14",
+	} {
+		resp, err := http.Get(srv.URL + "/probe?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestProbesDoNotGrowCacheOfLocations(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	e := newTestExporter(t, &types.Config{BaseURL: u.URL})
+
+	for i := 0; i < 5; i++ {
+		probe(t, e, 48.14, 17.1+float64(i))
+	}
+
+	e.cacheLock.RLock()
+	cached, probed := len(e.cache), len(e.probeCache)
+	e.cacheLock.RUnlock()
+	if cached != 0 {
+		t.Fatalf("expected probes not to store into cache of locations, got %d entries", cached)
+	}
+	if probed != 5 {
+		t.Fatalf("expected 5 entries in probe cache, got %d", probed)
+	}
+
+	// expired entries are dropped by next probe
+	e.cacheLock.Lock()
+	for key, entry := range e.probeCache {
+		entry.LastUpdate = entry.LastUpdate.Add(-time.Hour)
+		e.probeCache[key] = entry
+	}
+	e.cacheLock.Unlock()
+	probe(t, e, 48.72, 21.26)
+	e.cacheLock.RLock()
+	probed = len(e.probeCache)
+	e.cacheLock.RUnlock()
+	if probed != 1 {
+		t.Fatalf("expected expired entries to be evicted, got %d entries", probed)
+	}
+}
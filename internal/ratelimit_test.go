@@ -0,0 +1,87 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsFirstRequestImmediately(t *testing.T) {
+	l := newRateLimiter(60)
+	start := time.Now()
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("expected first request not to wait, waited %v", d)
+	}
+}
+
+func TestRateLimiterSpacesRequests(t *testing.T) {
+	// 600 per minute is one request every 100ms
+	l := newRateLimiter(600)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Fatalf("expected 3 requests to take at least 200ms, took %v", d)
+	}
+}
+
+func TestRateLimiterWithoutLimit(t *testing.T) {
+	l := newRateLimiter(0)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("expected unlimited requests not to wait, waited %v", d)
+	}
+}
+
+func TestRateLimiterHonorsContext(t *testing.T) {
+	l := newRateLimiter(1)
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled context to abort wait, got %v", err)
+	}
+
+	// next slot is a minute away, so waiting would exceed deadline
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.Wait(ctx); err == nil {
+		t.Fatal("expected wait exceeding deadline to fail")
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("expected wait exceeding deadline to fail immediately, waited %v", d)
+	}
+}
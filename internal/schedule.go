@@ -0,0 +1,152 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rkosegi/open-meteo-exporter/types"
+	"github.com/robfig/cron/v3"
+)
+
+// clock is source of time of schedules, so that they can be tested without waiting.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Start starts scheduled and background refreshes of locations, they are restarted after every reload.
+func (e *exporter) Start() {
+	e.reloadLock.Lock()
+	defer e.reloadLock.Unlock()
+	if e.stopped || e.started {
+		return
+	}
+	e.started = true
+	e.startBackground(e.schedCtx)
+}
+
+// startBackground starts scheduled and background refreshes of locations and pushes to OTLP receiver,
+// which run until ctx is done.
+func (e *exporter) startBackground(ctx context.Context) {
+	if cfg := e.cfg().OTLP; cfg != nil {
+		otlp, err := e.newOTLPExporter(ctx, cfg)
+		if err != nil {
+			e.logger.Error("Couldn't create OTLP exporter, metrics won't be pushed", "endpoint", cfg.Endpoint, "error", err)
+		}
+		e.otlp = otlp
+		if otlp != nil {
+			e.schedWg.Add(1)
+			go e.runOTLP(ctx, otlp)
+		}
+	}
+	e.startSchedules(ctx)
+	if e.cfg().BackgroundRefresh {
+		e.startBackgroundRefresh(ctx)
+	}
+}
+
+// startSchedules starts refresh goroutine for every location that has schedule configured.
+func (e *exporter) startSchedules(ctx context.Context) {
+	for _, loc := range e.cfg().Locations {
+		if loc.Schedule == "" || loc.Disabled {
+			continue
+		}
+		sched, err := cron.ParseStandard(loc.Schedule)
+		if err != nil {
+			e.logger.Error("Ignoring schedule of location", "location", loc.Name, "error", err)
+			continue
+		}
+		e.schedWg.Add(1)
+		go e.runSchedule(ctx, loc, sched)
+	}
+}
+
+// refresh fetches fresh data for location, bypassing cache, and pushes them to InfluxDB if configured.
+// Panic is recovered and counted as error, so that it can't affect refresh of other locations.
+func (e *exporter) refresh(ctx context.Context, loc types.Location) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.onError(loc, errorTypeOther, fmt.Errorf("panic while refreshing location %s: %v", loc.Name, r))
+		}
+	}()
+	e.scrapeTarget(withForceFetch(ctx), loc)
+	e.pushInflux(ctx, loc)
+}
+
+// runSchedule prefetches data for location and then refreshes them on every tick of schedule.
+func (e *exporter) runSchedule(ctx context.Context, loc types.Location, sched cron.Schedule) {
+	defer e.schedWg.Done()
+	e.refresh(ctx, loc)
+	for {
+		now := e.clock.Now()
+		next := sched.Next(now)
+		if next.IsZero() {
+			e.locLogger(loc).Warn("Schedule never fires, giving up", "schedule", loc.Schedule)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.clock.After(next.Sub(now)):
+			e.locLogger(loc).Debug("Refreshing location on schedule")
+			e.refresh(ctx, loc)
+		}
+	}
+}
+
+// startBackgroundRefresh starts refresh goroutine for every location without schedule,
+// which refreshes location once its TTL expires.
+func (e *exporter) startBackgroundRefresh(ctx context.Context) {
+	for _, loc := range e.cfg().Locations {
+		if loc.Schedule != "" || loc.Disabled {
+			continue
+		}
+		e.schedWg.Add(1)
+		go e.runBackgroundRefresh(ctx, loc)
+	}
+}
+
+// runBackgroundRefresh prefetches data for location and then refreshes them every TTL.
+func (e *exporter) runBackgroundRefresh(ctx context.Context, loc types.Location) {
+	defer e.schedWg.Done()
+	e.refresh(ctx, loc)
+	ticker := time.NewTicker(e.ttl(loc))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.locLogger(loc).Debug("Refreshing location in background")
+			e.refresh(ctx, loc)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+// fakeClock reports every wait on waits and fires it once test sends to tick.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits chan time.Duration
+	tick  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waits: make(chan time.Duration, 1), tick: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.tick
+}
+
+// advance moves clock by d and fires pending wait.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	c.tick <- now
+}
+
+func (c *fakeClock) nextWait(t *testing.T) time.Duration {
+	select {
+	case d := <-c.waits:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("schedule didn't wait for next tick")
+		return 0
+	}
+}
+
+func TestScheduleRefreshesOnTicks(t *testing.T) {
+	for _, tc := range []struct {
+		schedule string
+		first    time.Duration
+		second   time.Duration
+	}{
+		{schedule: "*/15 * * * *", first: 8 * time.Minute, second: 15 * time.Minute},
+		{schedule: "0 6-18 * * *", first: 53 * time.Minute, second: time.Hour},
+		{schedule: "@hourly", first: 53 * time.Minute, second: time.Hour},
+		{schedule: "@every 30m", first: 30 * time.Minute, second: 30 * time.Minute},
+	} {
+		t.Run(tc.schedule, func(t *testing.T) {
+			u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, currentWeatherJson)
+			})
+			clk := newFakeClock(time.Date(2024, 1, 1, 12, 7, 0, 0, time.Local))
+			loc := types.Location{Name: "Bratislava", Schedule: tc.schedule, BaseURL: u.URL,
+				Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+			e := newExporter(&types.Config{Locations: []types.Location{loc}},
+				slog.New(slog.NewTextHandler(io.Discard, nil)), time.Second, clk)
+			t.Cleanup(e.Stop)
+			e.Start()
+
+			if d := clk.nextWait(t); d != tc.first {
+				t.Fatalf("expected first tick in %v, got %v", tc.first, d)
+			}
+			if got := u.requests.Load(); got != 1 {
+				t.Fatalf("expected location to be prefetched, got %d requests", got)
+			}
+			clk.advance(tc.first)
+			if d := clk.nextWait(t); d != tc.second {
+				t.Fatalf("expected second tick in %v, got %v", tc.second, d)
+			}
+			if got := u.requests.Load(); got != 2 {
+				t.Fatalf("expected location to be refreshed on tick, got %d requests", got)
+			}
+		})
+	}
+}
+
+func TestInvalidScheduleIsIgnored(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	clk := newFakeClock(time.Date(2024, 1, 1, 12, 7, 0, 0, time.Local))
+	loc := types.Location{Name: "Bratislava", Schedule: "61 * * * *", BaseURL: u.URL,
+		Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newExporter(&types.Config{Locations: []types.Location{loc}},
+		slog.New(slog.NewTextHandler(io.Discard, nil)), time.Second, clk)
+	e.Start()
+	e.Stop()
+	if got := u.requests.Load(); got != 0 {
+		t.Fatalf("expected no refresh of location with invalid schedule, got %d requests", got)
+	}
+}
+
+// waitFor polls cond until it holds, failing test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestBackgroundRefreshIsolatesLocations(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("latitude") {
+		case "1.00":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "2.00":
+			_, _ = io.WriteString(w, `{"current": {"time": "2024-01-01T12:00", "uv_index": 3}}`)
+		default:
+			_, _ = io.WriteString(w, currentWeatherJson)
+		}
+	})
+	alt := types.FetchMethod(types.FetchMethodAlt)
+	failing := types.Location{Name: "Failing", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 1, Longitude: 1}}
+	panicking := types.Location{Name: "Panicking", FetchMethod: &alt, BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 2, Longitude: 2}}
+	healthy := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	cfg := &types.Config{Locations: []types.Location{failing, panicking, healthy}}
+	e := newTestExporter(t, cfg)
+	// gauge with unexpected labels makes handler of alt method panic
+	e.uvIndexDesc = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "uv_index"}, []string{"foo"})
+	e.Start()
+
+	bg := *cfg
+	bg.BackgroundRefresh = true
+	if err := e.Reload(&bg, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "refresh of all locations", func() bool {
+		return testutil.ToFloat64(e.scrapeErrors.WithLabelValues("Failing", errorTypeHttp)) == 1 &&
+			testutil.ToFloat64(e.scrapeErrors.WithLabelValues("Panicking", errorTypeOther)) == 1 &&
+			testutil.CollectAndCount(e.tempDesc) == 1
+	})
+	if got := testutil.ToFloat64(e.up.WithLabelValues("Bratislava")); got != 1 {
+		t.Errorf("expected healthy location to be up, got %v", got)
+	}
+	if got := testutil.ToFloat64(e.up.WithLabelValues("Failing")); got != 0 {
+		t.Errorf("expected failing location to be down, got %v", got)
+	}
+	if got := testutil.ToFloat64(e.scrapeErrors.WithLabelValues("Bratislava", errorTypeOther)); got != 0 {
+		t.Errorf("expected no errors of healthy location, got %v", got)
+	}
+}
+
+func TestFailedRefreshIsReportedByScrape(t *testing.T) {
+	var failing atomic.Bool
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{BackgroundRefresh: true, Locations: []types.Location{loc}})
+	e.Start()
+	waitFor(t, "initial refresh", func() bool {
+		_, present := e.cached(loc)
+		return present
+	})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+	scrape := func() {
+		if _, err := reg.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failing.Store(true)
+	e.refresh(context.Background(), loc)
+	scrape()
+	if got := testutil.ToFloat64(e.up.WithLabelValues("Bratislava")); got != 0 {
+		t.Fatalf("expected scrape to report failed refresh, got up=%v", got)
+	}
+	if got := testutil.CollectAndCount(e.tempDesc); got != 1 {
+		t.Fatalf("expected cached data to be exported until they expire, got %d series", got)
+	}
+	requests := u.requests.Load()
+
+	// once cached data expire, scrape fetches location itself instead of serving them
+	entry, _ := e.cached(loc)
+	entry.LastUpdate = entry.LastUpdate.Add(-time.Hour)
+	e.store(loc, entry)
+	scrape()
+	if got := u.requests.Load(); got != requests+1 {
+		t.Fatalf("expected scrape to fetch expired location, got %d requests", got-requests)
+	}
+	if got := testutil.ToFloat64(e.up.WithLabelValues("Bratislava")); got != 0 {
+		t.Fatalf("expected location to be down, got up=%v", got)
+	}
+	if got := testutil.CollectAndCount(e.tempDesc); got != 0 {
+		t.Fatalf("expected series of expired location to be removed, got %d", got)
+	}
+
+	failing.Store(false)
+	scrape()
+	if got := testutil.ToFloat64(e.up.WithLabelValues("Bratislava")); got != 1 {
+		t.Fatalf("expected location to recover, got up=%v", got)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"maps"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+// resetSeries deletes all series of location, so that outdated values are not exported.
+func (e *exporter) resetSeries(loc types.Location) {
+	for _, gv := range e.weatherGauges() {
+		gv.DeletePartialMatch(prometheus.Labels{"location": loc.Name})
+	}
+}
+
+// statusGauges returns gauges of exporter itself that are labelled by location and its static labels.
+func (e *exporter) statusGauges() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		e.up,
+		e.lastSuccess,
+		e.cacheAge,
+		e.cacheHitRatio,
+		e.generationTime,
+		e.lastResponseBytes,
+	}
+}
+
+// deleteSeries deletes series of removed location, including those of exporter itself, and forgets its status.
+func (e *exporter) deleteSeries(loc types.Location) {
+	labels := prometheus.Labels{"location": loc.Name}
+	e.resetSeries(loc)
+	for _, gv := range e.statusGauges() {
+		gv.DeletePartialMatch(labels)
+	}
+	for _, cv := range []*prometheus.CounterVec{e.cacheHit, e.cacheMiss, e.scrapeErrors, e.implausibleValues} {
+		cv.DeletePartialMatch(labels)
+	}
+	e.fetchDuration.DeletePartialMatch(labels)
+	e.statusLock.Lock()
+	delete(e.status, loc.Name)
+	e.statusLock.Unlock()
+}
+
+// labelsChanged returns true if series of location would carry different labels under new configuration.
+func labelsChanged(old, new types.Location) bool {
+	return !maps.Equal(old.Labels, new.Labels) || old.Coordinates != new.Coordinates ||
+		old.TemperatureUnit != new.TemperatureUnit || old.PrecipitationUnit != new.PrecipitationUnit ||
+		old.WindSpeedUnit != new.WindSpeedUnit || old.Models != new.Models || methodOf(old) != methodOf(new)
+}
+
+// dropStaleSeries deletes series of disabled or failing location, whose values are no longer up to date.
+// Last known values of failing location are exported until its cached data expire. With drop_stale_series
+// enabled, series of disabled locations and of locations that failed stale_after_failures times in row
+// are deleted right away, so that Prometheus marks them stale on next scrape.
+func (e *exporter) dropStaleSeries(loc types.Location) {
+	e.statusLock.Lock()
+	failures := e.locStatus(loc.Name).failures
+	e.statusLock.Unlock()
+	cfg := e.cfg()
+	switch {
+	case loc.Disabled:
+		if cfg.DropStaleSeries {
+			e.resetSeries(loc)
+		}
+	case failures == 0:
+		// location is healthy, its series are up to date
+	case cfg.DropStaleSeries && cfg.StaleAfterFailures > 0 && failures >= cfg.StaleAfterFailures:
+		e.resetSeries(loc)
+	default:
+		if entry, present := e.cached(loc); !present || time.Since(entry.LastUpdate) >= e.ttl(loc) {
+			e.resetSeries(loc)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+func TestDropStaleSeries(t *testing.T) {
+	var failing atomic.Bool
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	disabled := types.Location{Name: "Vienna", Disabled: true}
+	e := newTestExporter(t, &types.Config{DropStaleSeries: true, StaleAfterFailures: 2, Locations: []types.Location{loc, disabled}})
+	// series left over from time when location was enabled
+	e.setGauge(disabled, "temperature", e.tempDesc, 1, "celsius", "", "48.21", "16.37")
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	countSeries := func() int {
+		n, err := testutil.GatherAndCount(reg, "openmeteo_current_temperature")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if got := countSeries(); got != 1 {
+		t.Fatalf("expected only series of enabled location, got %d", got)
+	}
+
+	failing.Store(true)
+	e.refresh(context.Background(), loc)
+	if got := countSeries(); got != 1 {
+		t.Fatalf("expected series to be kept after single failure, got %d", got)
+	}
+	e.refresh(context.Background(), loc)
+	if got := countSeries(); got != 0 {
+		t.Fatalf("expected series of persistently failing location to be removed, got %d", got)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), "openmeteo_current_") && len(mf.GetMetric()) > 0 {
+			t.Errorf("unexpected series of %s", mf.GetName())
+		}
+	}
+}
+
+func TestSeriesRemovedOnceCacheExpires(t *testing.T) {
+	var failing atomic.Bool
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	loc := types.Location{Name: "Bratislava", BaseURL: u.URL, TtlMinutes: 5, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{loc}})
+	countSeries := func() int {
+		return testutil.CollectAndCount(e.tempDesc)
+	}
+
+	e.handleDefault(context.Background(), loc)
+	if got := countSeries(); got != 1 {
+		t.Fatalf("expected series after successful fetch, got %d", got)
+	}
+
+	// failure while cached data are still valid keeps last known values
+	failing.Store(true)
+	e.handleDefault(withForceFetch(context.Background()), loc)
+	if got := countSeries(); got != 1 {
+		t.Fatalf("expected series to be kept while cache is valid, got %d", got)
+	}
+
+	entry, _ := e.cached(loc)
+	entry.LastUpdate = entry.LastUpdate.Add(-10 * time.Minute)
+	e.store(loc, entry)
+	e.handleDefault(context.Background(), loc)
+	if got := countSeries(); got != 0 {
+		t.Fatalf("expected series to be removed once cache expired, got %d", got)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type targetStatus struct {
+	Name          string     `json:"name"`
+	Latitude      float64    `json:"latitude"`
+	Longitude     float64    `json:"longitude"`
+	Method        string     `json:"method"`
+	Disabled      bool       `json:"disabled,omitempty"`
+	Up            bool       `json:"up"`
+	Failures      int        `json:"consecutive_failures"`
+	LastUpdate    *time.Time `json:"last_update,omitempty"`
+	CacheAge      *float64   `json:"cache_age_seconds,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// targets returns status of all configured locations, in order of configuration.
+func (e *exporter) targets() []targetStatus {
+	locs := e.cfg().Locations
+	result := make([]targetStatus, 0, len(locs))
+	for _, loc := range locs {
+		ts := targetStatus{
+			Name:      loc.Name,
+			Latitude:  loc.Latitude,
+			Longitude: loc.Longitude,
+			Method:    string(methodOf(loc)),
+			Disabled:  loc.Disabled,
+		}
+		if entry, present := e.cached(loc); present {
+			lastUpdate := entry.LastUpdate
+			age := time.Since(lastUpdate).Seconds()
+			ts.LastUpdate, ts.CacheAge = &lastUpdate, &age
+		}
+		e.statusLock.Lock()
+		if st, ok := e.status[loc.Name]; ok {
+			ts.Up = st.attempted && st.failures == 0
+			ts.Failures = st.failures
+			if st.lastError != "" {
+				lastErrorTime := st.lastErrorTime
+				ts.LastError, ts.LastErrorTime = st.lastError, &lastErrorTime
+			}
+		}
+		e.statusLock.Unlock()
+		result = append(result, ts)
+	}
+	return result
+}
+
+// TargetsHandler serves status of all locations as JSON, so that missing data can be triaged without Prometheus.
+func (e *exporter) TargetsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(e.targets())
+	})
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+type weatherReport struct {
+	Location   string      `json:"location"`
+	Latitude   float64     `json:"latitude"`
+	Longitude  float64     `json:"longitude"`
+	LastUpdate time.Time   `json:"last_update"`
+	Data       interface{} `json:"data"`
+}
+
+// reportData extracts readings from cached response, leaving out response metadata.
+func reportData(resp interface{}) interface{} {
+	switch r := resp.(type) {
+	case *types.Response:
+		return r.CurrentWeather
+	case *types.ResponseAlt:
+		return r.CurrentWeather
+	case *types.ResponseDaily:
+		return r.Daily
+	case *types.ResponseHourly:
+		return r.Hourly
+	case *types.ResponseAirQuality:
+		return r.Current
+	case *types.MarineResponse:
+		return r.Current
+	case *types.FloodResponse:
+		return r.Daily
+	}
+	return resp
+}
+
+func (e *exporter) lookupLocation(name string) (types.Location, bool) {
+	for _, loc := range e.cfg().Locations {
+		if loc.Name == name {
+			return loc, true
+		}
+	}
+	return types.Location{}, false
+}
+
+// WeatherHandler serves latest cached readings of location given by "location" query parameter as JSON.
+func (e *exporter) WeatherHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("location")
+		loc, found := e.lookupLocation(name)
+		if !found {
+			http.Error(w, "Unknown location", http.StatusNotFound)
+			return
+		}
+		entry, present := e.cached(loc)
+		if !present {
+			http.Error(w, "No data available for location yet", http.StatusNotFound)
+			return
+		}
+		// report is encoded upfront, so that encoding error can still be reported by status
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(weatherReport{
+			Location:   loc.Name,
+			Latitude:   loc.Latitude,
+			Longitude:  loc.Longitude,
+			LastUpdate: entry.LastUpdate,
+			Data:       reportData(entry.Response),
+		}); err != nil {
+			e.locLogger(loc).Error("Couldn't encode weather report", "error", err)
+			http.Error(w, "Couldn't encode weather report", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+func TestWeatherHandler(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, currentWeatherJson)
+	})
+	fetched := types.Location{Name: "Bratislava", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	pending := types.Location{Name: "Vienna", BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.21, Longitude: 16.37}}
+	e := newTestExporter(t, &types.Config{Locations: []types.Location{fetched, pending}})
+	e.handleDefault(context.Background(), fetched)
+	srv := httptest.NewServer(e.WeatherHandler())
+	defer srv.Close()
+
+	get := func(name string) (*http.Response, []byte) {
+		resp, err := http.Get(srv.URL + "/weather?location=" + url.QueryEscape(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	resp, body := get("Bratislava")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("content-type") != "application/json" {
+		t.Fatalf("unexpected response %d (%s): %s", resp.StatusCode, resp.Header.Get("content-type"), body)
+	}
+	var report map[string]interface{}
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report["location"] != "Bratislava" || report["latitude"] != 48.14 || report["longitude"] != 17.1 || report["last_update"] == nil {
+		t.Fatalf("unexpected report: %s", body)
+	}
+	expectedData := map[string]interface{}{"time": "2024-01-01T12:00", "temperature": 3.5, "windspeed": 12.0, "winddirection": 270.0}
+	data, _ := report["data"].(map[string]interface{})
+	if len(data) != len(expectedData) {
+		t.Fatalf("unexpected data: %s", body)
+	}
+	for k, v := range expectedData {
+		if data[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, data[k])
+		}
+	}
+
+	for _, name := range []string{"Budapest", "Vienna"} {
+		if resp, body = get(name); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected 404 for %s, got %d: %s", name, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestWeatherHandlerEncodesNonFiniteAsNull(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"current": {"time": "2024-01-01T12:00", "temperature_2m": "NaN", "wind_speed_10m": 12.0}}`)
+	})
+	method := types.FetchMethod(types.FetchMethodAlt)
+	loc := types.Location{Name: "Bratislava", FetchMethod: &method, BaseURL: u.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}}
+	e := newTestExporter(t, &types.Config{NonFinitePolicy: types.NonFinitePolicyKeep, Locations: []types.Location{loc}})
+	e.handleAlt(context.Background(), loc)
+
+	rec := httptest.NewRecorder()
+	e.WeatherHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/weather?location=Bratislava", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	var report struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid report %q: %v", rec.Body, err)
+	}
+	if v, ok := report.Data["temperature_2m"]; !ok || v != nil {
+		t.Errorf("expected NaN temperature to be null, got %v", v)
+	}
+	if v := report.Data["wind_speed_10m"]; v != 12.0 {
+		t.Errorf("expected wind speed 12, got %v", v)
+	}
+}
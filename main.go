@@ -17,10 +17,19 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -30,14 +39,15 @@ import (
 	"github.com/prometheus/client_golang/prometheus/collectors/version"
 
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/common/promslog/flag"
 	pv "github.com/prometheus/common/version"
 	"github.com/prometheus/exporter-toolkit/web"
 	webflag "github.com/prometheus/exporter-toolkit/web/kingpinflag"
-	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -60,21 +70,388 @@ var (
 		"disable-default-metrics",
 		"Exclude default metrics about the exporter itself (promhttp_*, process_*, go_*).",
 	).Bool()
+
+	timeoutOffset = kingpin.Flag(
+		"web.timeout-offset",
+		"Offset to subtract from scrape timeout advertised by Prometheus, half of the timeout is used when offset exceeds it.",
+	).Default("500ms").Duration()
+
+	shutdownTimeout = kingpin.Flag(
+		"web.shutdown-timeout",
+		"Maximum time to wait for in-flight requests to finish on shutdown.",
+	).Default("30s").Duration()
+
+	oneshot = kingpin.Flag(
+		"oneshot",
+		"Scrape all locations once, print metrics to stdout in text format and exit.",
+	).Bool()
+
+	httpTimeout = kingpin.Flag(
+		"http.timeout",
+		"Timeout of HTTP requests to API.",
+	).Default("30s").Duration()
+
+	checkConfig = kingpin.Flag(
+		"check-config",
+		"Load and validate configuration, then exit without starting the server.",
+	).Bool()
+
+	// locations watches locations file of current configuration, if any
+	locations *locationsWatcher
 )
 
+// expandEnv substitutes ${VAR} and $VAR references with values of environment variables.
+// Literal dollar sign can be escaped as $$.
+func expandEnv(data []byte) []byte {
+	return []byte(os.Expand(string(data), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
+	}))
+}
+
+// loadConfig loads config from file, or merges all *.yaml files when cfgFile is directory.
 func loadConfig(cfgFile string) (*types.Config, error) {
+	fi, err := os.Stat(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfg *types.Config
+	baseDir := filepath.Dir(cfgFile)
+	if fi.IsDir() {
+		baseDir = cfgFile
+		cfg, err = loadConfigDir(cfgFile)
+	} else {
+		cfg, err = loadConfigFile(cfgFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = loadLocationsFile(cfg, baseDir); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadConfigFile(cfgFile string) (*types.Config, error) {
 	var cfg types.Config
 	data, err := os.ReadFile(cfgFile)
 	if err != nil {
 		return nil, err
 	}
-	err = yaml.Unmarshal(data, &cfg)
+	data = expandEnv(data)
+	if err = types.DecodeStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", cfgFile, err)
+	}
+	return &cfg, nil
+}
+
+// loadConfigDir merges config fragments in directory in lexical order of their names.
+func loadConfigDir(dir string) (*types.Config, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
 	if err != nil {
 		return nil, err
 	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.yaml files found in config directory %s", dir)
+	}
+	var cfg types.Config
+	for _, file := range files {
+		fragment, err := loadConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err = cfg.Merge(fragment); err != nil {
+			return nil, fmt.Errorf("can't merge config file %s: %w", file, err)
+		}
+	}
 	return &cfg, nil
 }
 
+// loadLocationsFile appends locations from locations file (YAML or JSON list) to config.
+// Relative path is resolved against baseDir, which is directory of config file(s).
+func loadLocationsFile(cfg *types.Config, baseDir string) error {
+	if cfg.LocationsFile == "" {
+		return nil
+	}
+	if !filepath.IsAbs(cfg.LocationsFile) {
+		cfg.LocationsFile = filepath.Join(baseDir, cfg.LocationsFile)
+	}
+	data, err := os.ReadFile(cfg.LocationsFile)
+	if err != nil {
+		return err
+	}
+	var locations []types.Location
+	data = expandEnv(data)
+	if err = types.DecodeStrict(data, &locations); err != nil {
+		return fmt.Errorf("invalid locations file %s: %w", cfg.LocationsFile, err)
+	}
+	cfg.Locations = append(cfg.Locations, locations...)
+	return nil
+}
+
+// fileState identifies content of file without reading it.
+type fileState struct {
+	// target is path file resolves to, it changes when symlink is swapped (e.g. Kubernetes ConfigMap update)
+	target string
+	mtime  time.Time
+	size   int64
+}
+
+func statFile(path string) (fileState, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{target: target, mtime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// locationsWatcher watches locations file and calls onChange whenever it changes.
+// Directory of file is watched rather than file itself, so that atomic replacement of file
+// (rename of temporary file, as done by editors and config management tools) is noticed too.
+type locationsWatcher struct {
+	watcher  *fsnotify.Watcher
+	logger   *slog.Logger
+	onChange func()
+
+	lock  sync.Mutex
+	path  string
+	dir   string
+	state fileState
+}
+
+func newLocationsWatcher(logger *slog.Logger, onChange func()) (*locationsWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &locationsWatcher{watcher: watcher, logger: logger, onChange: onChange}, nil
+}
+
+// watch switches watcher to given locations file, empty path stops watching.
+func (w *locationsWatcher) watch(path string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	dir := ""
+	if path != "" {
+		dir = filepath.Dir(path)
+	}
+	if dir != w.dir {
+		if w.dir != "" {
+			_ = w.watcher.Remove(w.dir)
+		}
+		if dir != "" {
+			if err := w.watcher.Add(dir); err != nil {
+				w.logger.Warn("Couldn't watch locations file", "path", path, "err", err)
+				dir = ""
+			}
+		}
+		w.dir = dir
+	}
+	w.path = path
+	w.state, _ = statFile(path)
+}
+
+// changed reports whether locations file differs from the last time it was seen, along with path of the file.
+func (w *locationsWatcher) changed() (string, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.path == "" {
+		return "", false
+	}
+	state, err := statFile(w.path)
+	if err != nil {
+		// file is missing in the middle of replacement, next event will tell
+		return w.path, false
+	}
+	if state == w.state {
+		return w.path, false
+	}
+	w.state = state
+	return w.path, true
+}
+
+// run processes file system events until watcher is closed.
+func (w *locationsWatcher) run() {
+	for {
+		select {
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if path, changed := w.changed(); changed {
+				w.logger.Info("Locations file changed, reloading configuration", "path", path)
+				w.onChange()
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Warn("Error while watching locations file", "err", err)
+		}
+	}
+}
+
+func (w *locationsWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// configModTime returns modification time of config file, or of the most recently modified fragment
+// when config is directory, since modification of fragment doesn't change time of directory itself.
+func configModTime(cfgFile string) (time.Time, error) {
+	fi, err := os.Stat(cfgFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !fi.IsDir() {
+		return fi.ModTime(), nil
+	}
+	files, err := filepath.Glob(filepath.Join(cfgFile, "*.yaml"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	var newest time.Time
+	for _, file := range files {
+		if fi, err = os.Stat(file); err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// configMtime returns modification time of config file, or zero time when it can't be determined.
+func configMtime(cfgFile string, logger *slog.Logger) time.Time {
+	mtime, err := configModTime(cfgFile)
+	if err != nil {
+		logger.Warn("Couldn't determine config file modification time", "err", err)
+		return time.Time{}
+	}
+	return mtime
+}
+
+// checkConfiguration loads and validates config file, prints outcome to stdout and returns exit code.
+func checkConfiguration(logger *slog.Logger) int {
+	config, err := loadConfig(*cfgFile)
+	if err == nil {
+		err = config.Validate(logger)
+	}
+	if err != nil {
+		fmt.Printf("Configuration %s is invalid: %v\n", *cfgFile, err)
+		return 1
+	}
+	fmt.Printf("Configuration %s is valid, %d valid locations\n", *cfgFile, len(config.Locations))
+	return 0
+}
+
+// reloadConfig loads and validates config file and swaps it into running exporter.
+func reloadConfig(exporter internal.Exporter, logger *slog.Logger) error {
+	config, err := loadConfig(*cfgFile)
+	if err != nil {
+		return err
+	}
+	if err = config.Validate(logger); err != nil {
+		return err
+	}
+	if err = exporter.Reload(config, configMtime(*cfgFile, logger)); err != nil {
+		return err
+	}
+	if locations != nil {
+		locations.watch(config.LocationsFile)
+	}
+	return nil
+}
+
+// writeMetrics gathers all metrics from g and writes them to w in text exposition format.
+func writeMetrics(g prometheus.Gatherer, w io.Writer) error {
+	mfs, gatherErr := g.Gather()
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return gatherErr
+}
+
+// scrapeContext returns context of scrape request, bound to scrape timeout advertised by Prometheus (minus offset).
+// When offset doesn't leave any time for scrape, half of advertised timeout is used instead.
+func scrapeContext(req *http.Request, offset time.Duration) (context.Context, context.CancelFunc) {
+	if v := req.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+			advertised := time.Duration(secs * float64(time.Second))
+			timeout := advertised - offset
+			if timeout <= 0 {
+				timeout = advertised / 2
+			}
+			return context.WithTimeout(req.Context(), timeout)
+		}
+	}
+	return context.WithCancel(req.Context())
+}
+
+// gatherWith returns gatherer which gathers from g and from c.
+func gatherWith(g prometheus.Gatherer, c prometheus.Collector) prometheus.Gatherer {
+	cr := prometheus.NewRegistry()
+	cr.MustRegister(c)
+	return prometheus.Gatherers{g, cr}
+}
+
+// drainer tracks requests in flight, so that drain can wait for them before exporter is stopped.
+type drainer struct {
+	lock     sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
+}
+
+// start switches to drain mode, it returns false if drain was already started.
+func (d *drainer) start() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.draining {
+		return false
+	}
+	d.draining = true
+	return true
+}
+
+// wait waits until requests accepted before drain finish, it returns false if timeout elapses first.
+func (d *drainer) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		d.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// drainable rejects requests with 503 once drain is started, otherwise it passes them to next handler.
+func drainable(d *drainer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.lock.Lock()
+		if d.draining {
+			d.lock.Unlock()
+			http.Error(w, "Exporter is draining", http.StatusServiceUnavailable)
+			return
+		}
+		d.inFlight.Add(1)
+		d.lock.Unlock()
+		defer d.inFlight.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
 func main() {
 	promlogConfig := &promslog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
@@ -88,9 +465,22 @@ func main() {
 		"config", *cfgFile)
 	logger.Info("Build context", "build_context", pv.BuildContext())
 
+	if *checkConfig {
+		os.Exit(checkConfiguration(logger))
+	}
+	if *httpTimeout <= 0 {
+		logger.Error("HTTP timeout must be positive", "timeout", *httpTimeout)
+		os.Exit(1)
+	}
+
 	config, err := loadConfig(*cfgFile)
 	if err != nil {
-		panic(err)
+		logger.Error("Couldn't load configuration", "config", *cfgFile, "err", err)
+		os.Exit(1)
+	}
+	if err = config.Validate(logger); err != nil {
+		logger.Error("Invalid configuration", "err", err)
+		os.Exit(1)
 	}
 
 	logger.Info(fmt.Sprintf("Got %d targets", len(config.Locations)))
@@ -98,17 +488,36 @@ func main() {
 	r := prometheus.NewRegistry()
 	r.MustRegister(version.NewCollector(name))
 
-	if err := r.Register(internal.NewExporter(config, logger)); err != nil {
+	// exporter is not registered in r, it's gathered separately for every scrape request,
+	// bound to context of that request. Registration here just validates its descriptors.
+	exporter := internal.NewExporter(config, configMtime(*cfgFile, logger), logger, *httpTimeout)
+	if err := prometheus.NewRegistry().Register(exporter); err != nil {
 		logger.Error("Couldn't register "+name, "err", err)
 		os.Exit(1)
 	}
 
-	handler := promhttp.HandlerFor(
-		prometheus.Gatherers{r},
-		promhttp.HandlerOpts{
-			ErrorHandling: promhttp.ContinueOnError,
-		},
-	)
+	if *oneshot {
+		err = writeMetrics(gatherWith(r, exporter), os.Stdout)
+		exporter.Stop()
+		if err != nil {
+			logger.Error("Error while gathering metrics", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	exporter.Start()
+	exporter.CheckCapabilities()
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := scrapeContext(req, *timeoutOffset)
+		defer cancel()
+		promhttp.HandlerFor(
+			gatherWith(r, exporter.WithContext(ctx)),
+			promhttp.HandlerOpts{
+				ErrorHandling: promhttp.ContinueOnError,
+			},
+		).ServeHTTP(w, req)
+	})
 
 	if !*disableDefaultMetrics {
 		r.MustRegister(collectors.NewGoCollector())
@@ -130,6 +539,18 @@ func main() {
 				Address: "/health",
 				Text:    "Health",
 			},
+			{
+				Address: "/weather",
+				Text:    "Weather",
+			},
+			{
+				Address: "/targets",
+				Text:    "Targets",
+			},
+			{
+				Address: "/config",
+				Text:    "Configuration",
+			},
 		},
 	})
 	if err != nil {
@@ -137,18 +558,102 @@ func main() {
 		os.Exit(1)
 	}
 
+	var drain drainer
 	http.Handle("/", landingPage)
 	http.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
 	})
-	http.Handle(*metricPath, handler)
+	http.Handle("/weather", exporter.WeatherHandler())
+	http.Handle("/config", exporter.ConfigHandler())
+	http.Handle("/targets", exporter.TargetsHandler())
+	probeHandler := exporter.ProbeHandler()
+	http.Handle("/probe", drainable(&drain, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := scrapeContext(req, *timeoutOffset)
+		defer cancel()
+		probeHandler.ServeHTTP(w, req.WithContext(ctx))
+	})))
+	// like all other handlers, reload is protected by authentication configured in web config file, if any
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		logger.Info("Reloading configuration", "config", *cfgFile)
+		if err := reloadConfig(exporter, logger); err != nil {
+			logger.Error("Couldn't reload configuration, keeping current one", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("OK"))
+	})
+	http.Handle(*metricPath, drainable(&drain, handler))
+
+	drainCh := make(chan os.Signal, 1)
+	signal.Notify(drainCh, syscall.SIGUSR1)
+	go func() {
+		for range drainCh {
+			if !drain.start() {
+				continue
+			}
+			logger.Info("Draining, new scrapes will be rejected")
+			// cache is saved by Stop, so it has to include data fetched by scrapes in flight
+			if !drain.wait(*shutdownTimeout) {
+				logger.Warn("Couldn't finish in-flight scrapes in time", "timeout", *shutdownTimeout)
+			}
+			exporter.Stop()
+			logger.Info("Drain complete, waiting for termination")
+		}
+	}()
+
+	locations, err = newLocationsWatcher(logger, func() {
+		if err := reloadConfig(exporter, logger); err != nil {
+			logger.Error("Couldn't reload configuration, keeping current one", "err", err)
+		}
+	})
+	if err != nil {
+		logger.Error("Couldn't create watcher of locations file, changes won't be reloaded", "err", err)
+	} else {
+		locations.watch(config.LocationsFile)
+		go locations.run()
+	}
+
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go func() {
+		for range reloadCh {
+			logger.Info("Reloading configuration", "config", *cfgFile)
+			if err := reloadConfig(exporter, logger); err != nil {
+				logger.Error("Couldn't reload configuration, keeping current one", "err", err)
+			}
+		}
+	}()
 
 	srv := &http.Server{
 		ReadHeaderTimeout: 10 * time.Second,
 	}
-	if err := web.ListenAndServe(srv, toolkitFlags, logger); err != nil {
+	shutdownCh := make(chan os.Signal, 1)
+	signal.Notify(shutdownCh, syscall.SIGTERM, os.Interrupt)
+	shutdownDone := make(chan struct{})
+	go func() {
+		sig := <-shutdownCh
+		logger.Info("Shutting down, waiting for in-flight requests", "signal", sig, "timeout", *shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Warn("Couldn't finish in-flight requests in time", "err", err)
+		}
+		logger.Info("Stopping background activities")
+		exporter.Stop()
+		logger.Info("Shutdown complete")
+		close(shutdownDone)
+	}()
+
+	if err := web.ListenAndServe(srv, toolkitFlags, logger); !errors.Is(err, http.ErrServerClosed) {
 		logger.Error("Error starting server", "err", err)
+		exporter.Stop()
 		os.Exit(1)
 	}
+	<-shutdownDone
 }
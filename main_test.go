@@ -0,0 +1,444 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rkosegi/open-meteo-exporter/internal"
+	"github.com/rkosegi/open-meteo-exporter/types"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigExpandsEnvOnce(t *testing.T) {
+	t.Setenv("OPEN_METEO_API_KEY", "key$SUFFIX")
+	t.Setenv("SUFFIX", "oops")
+	t.Setenv("LAT_HOME", "48.14")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, `api_key: ${OPEN_METEO_API_KEY}
+locations:
+  - name: Home
+    latitude: $LAT_HOME
+    longitude: 17.1
+    labels:
+      price: $$5
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Validate(discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.APIKey != "key$SUFFIX" {
+		t.Errorf("expected value of variable to be used verbatim, got %q", cfg.APIKey)
+	}
+	if cfg.Locations[0].Latitude != 48.14 {
+		t.Errorf("expected latitude from environment, got %v", cfg.Locations[0].Latitude)
+	}
+	if cfg.Locations[0].Labels["price"] != "$5" {
+		t.Errorf("expected escaped dollar sign, got %q", cfg.Locations[0].Labels["price"])
+	}
+}
+
+func newTestWatcher(t *testing.T, path string) <-chan struct{} {
+	changes := make(chan struct{}, 10)
+	w, err := newLocationsWatcher(discardLogger, func() {
+		changes <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = w.Close()
+	})
+	w.watch(path)
+	go w.run()
+	return changes
+}
+
+// expectChange waits for change, writing file may be noticed more than once (truncate, then write),
+// so further changes shortly after the first one are drained.
+func expectChange(t *testing.T, changes <-chan struct{}, what string) {
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("change wasn't noticed: %s", what)
+	}
+	for {
+		select {
+		case <-changes:
+		case <-time.After(100 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func expectNoChange(t *testing.T, changes <-chan struct{}, what string) {
+	select {
+	case <-changes:
+		t.Fatalf("unexpected change: %s", what)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestLocationsWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "locations.yaml")
+	writeFile(t, path, "- name: A\n")
+	changes := newTestWatcher(t, path)
+
+	writeFile(t, path, "- name: A\n- name: B\n")
+	expectChange(t, changes, "file written in place")
+
+	tmp := filepath.Join(dir, ".locations.yaml.tmp")
+	writeFile(t, tmp, "- name: A\n- name: B\n- name: C\n")
+	expectNoChange(t, changes, "temporary file created")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, changes, "file replaced by rename")
+
+	writeFile(t, filepath.Join(dir, "other.yaml"), "foo: bar\n")
+	expectNoChange(t, changes, "other file in directory")
+}
+
+func TestLocationsWatcherSymlinkSwap(t *testing.T) {
+	// layout used by Kubernetes ConfigMap volumes
+	dir := t.TempDir()
+	for _, v := range []string{"v1", "v2"} {
+		if err := os.Mkdir(filepath.Join(dir, v), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(dir, "v1", "locations.yaml"), "- name: A\n")
+	writeFile(t, filepath.Join(dir, "v2", "locations.yaml"), "- name: B\n")
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "locations.yaml")
+	if err := os.Symlink(filepath.Join("..data", "locations.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+	changes := newTestWatcher(t, path)
+
+	if err := os.Symlink("v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, changes, "symlink swapped")
+}
+
+func TestLocationsFileChangeReloadsExporter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	locsPath := filepath.Join(dir, "locations.yaml")
+	writeFile(t, path, "locations_file: locations.yaml\n")
+	writeFile(t, locsPath, "- name: A\n  latitude: 48.14\n  longitude: 17.1\n")
+	orig := *cfgFile
+	*cfgFile = path
+	t.Cleanup(func() {
+		*cfgFile = orig
+	})
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := internal.NewExporter(config, time.Time{}, discardLogger, time.Second)
+	t.Cleanup(exporter.Stop)
+	names := func() []string {
+		rec := httptest.NewRecorder()
+		exporter.TargetsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/targets", nil))
+		var targets []struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &targets); err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, target := range targets {
+			result = append(result, target.Name)
+		}
+		return result
+	}
+	if got := names(); !slices.Equal(got, []string{"A"}) {
+		t.Fatalf("unexpected initial locations: %v", got)
+	}
+
+	reloaded := make(chan struct{}, 10)
+	w, err := newLocationsWatcher(discardLogger, func() {
+		if err := reloadConfig(exporter, discardLogger); err != nil {
+			t.Error(err)
+		}
+		reloaded <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = w.Close()
+	})
+	w.watch(config.LocationsFile)
+	go w.run()
+
+	// file is replaced atomically, so that reload never sees it half-written
+	tmp := filepath.Join(dir, ".locations.yaml.tmp")
+	writeFile(t, tmp, "- name: A\n  latitude: 48.14\n  longitude: 17.1\n- name: B\n  latitude: 48.72\n  longitude: 21.26\n")
+	if err = os.Rename(tmp, locsPath); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, reloaded, "locations file rewritten")
+	if got := names(); !slices.Equal(got, []string{"A", "B"}) {
+		t.Fatalf("expected locations of rewritten file, got %v", got)
+	}
+}
+
+func TestConfigModTimeOfDirectory(t *testing.T) {
+	dir := t.TempDir()
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for name, mtime := range map[string]time.Time{"10-base.yaml": newer, "20-locations.yaml": older} {
+		path := filepath.Join(dir, name)
+		writeFile(t, path, "locations: []\n")
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(dir, older, older); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime, err := configModTime(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mtime.Equal(newer) {
+		t.Fatalf("expected time of newest fragment %v, got %v", newer, mtime)
+	}
+}
+
+func TestConfigMtimeOfFileAfterLoadAndReload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"current_weather": {"time": "2024-01-01T12:00", "temperature": 3.5}}`)
+	}))
+	defer upstream.Close()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	orig := *cfgFile
+	*cfgFile = path
+	t.Cleanup(func() {
+		*cfgFile = orig
+	})
+	setMtime := func(mtime time.Time) {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeFile(t, path, "base_url: "+upstream.URL+"\nlocations:\n  - name: A\n    latitude: 48.14\n    longitude: 17.1\n")
+	setMtime(loaded)
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := internal.NewExporter(config, configMtime(path, discardLogger), discardLogger, time.Second)
+	t.Cleanup(exporter.Stop)
+	r := prometheus.NewRegistry()
+	r.MustRegister(exporter)
+	expectMtime := func(mtime time.Time) {
+		expected := fmt.Sprintf(`
+# HELP openmeteo_exporter_config_file_mtime_seconds Modification time of the loaded config file (newest fragment of config directory), in seconds since epoch.
+# TYPE openmeteo_exporter_config_file_mtime_seconds gauge
+openmeteo_exporter_config_file_mtime_seconds %d
+`, mtime.Unix())
+		if err := testutil.GatherAndCompare(r, strings.NewReader(expected), "openmeteo_exporter_config_file_mtime_seconds"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMtime(loaded)
+
+	reloaded := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	writeFile(t, path, "base_url: "+upstream.URL+"\nlocations:\n  - name: B\n    latitude: 48.72\n    longitude: 21.26\n")
+	setMtime(reloaded)
+	if err = reloadConfig(exporter, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	expectMtime(reloaded)
+}
+
+func TestWriteMetricsOneshot(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = io.WriteString(w, `{"current_weather": {"time": "2024-01-01T12:00", "temperature": 3.5}}`)
+	}))
+	defer upstream.Close()
+	exporter := internal.NewExporter(&types.Config{BackgroundRefresh: true, Locations: []types.Location{
+		{Name: "Bratislava", BaseURL: upstream.URL, Coordinates: types.Coordinates{Latitude: 48.14, Longitude: 17.1}},
+	}}, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), discardLogger, time.Second)
+	r := prometheus.NewRegistry()
+
+	var out bytes.Buffer
+	err := writeMetrics(gatherWith(r, exporter), &out)
+	exporter.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE openmeteo_current_temperature gauge\n",
+		`openmeteo_current_temperature{latitude="48.14",location="Bratislava",longitude="17.10",model="",unit="celsius"} 3.5` + "\n",
+		"# TYPE openmeteo_exporter_config_file_mtime_seconds gauge\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("output doesn't contain %q:\n%s", line, out.String())
+		}
+	}
+	// neither capabilities are probed nor background refresh is started in oneshot mode, only location itself is fetched
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected 1 upstream request, got %d", got)
+	}
+}
+
+func TestDrainableRejectsRequestsWhileDraining(t *testing.T) {
+	var drain drainer
+	srv := httptest.NewServer(drainable(&drain, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "metrics")
+	})))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		draining bool
+		status   int
+	}{
+		{draining: false, status: http.StatusOK},
+		{draining: true, status: http.StatusServiceUnavailable},
+	} {
+		if tc.draining && !drain.start() {
+			t.Fatal("expected drain to start")
+		}
+		resp, err := http.Get(srv.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("draining=%v: expected status %d, got %d", tc.draining, tc.status, resp.StatusCode)
+		}
+	}
+	if drain.start() {
+		t.Error("expected drain to be started only once")
+	}
+}
+
+func TestDrainWaitsForRequestsInFlight(t *testing.T) {
+	var drain drainer
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(drainable(&drain, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(entered)
+		<-release
+		_, _ = io.WriteString(w, "metrics")
+	})))
+	defer srv.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/metrics")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-entered
+	drain.start()
+	if drain.wait(100 * time.Millisecond) {
+		t.Fatal("expected drain to wait for request in flight")
+	}
+	close(release)
+	if !drain.wait(5 * time.Second) {
+		t.Fatal("expected drain to finish once request in flight is done")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrapeContextHonorsScrapeTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		timeout time.Duration
+	}{
+		{header: "", timeout: 0},
+		{header: "2", timeout: 1500 * time.Millisecond},
+		{header: "0.75", timeout: 250 * time.Millisecond},
+		{header: "0.5", timeout: 250 * time.Millisecond},
+		{header: "0.2", timeout: 100 * time.Millisecond},
+		{header: "abc", timeout: 0},
+		{header: "0", timeout: 0},
+	} {
+		t.Run(tc.header, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.header != "" {
+				req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tc.header)
+			}
+			start := time.Now()
+			ctx, cancel := scrapeContext(req, 500*time.Millisecond)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			if tc.timeout == 0 {
+				if ok {
+					t.Fatalf("expected no deadline, got %v", deadline.Sub(start))
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("expected deadline")
+			}
+			if d := deadline.Sub(start); d < tc.timeout || d > tc.timeout+100*time.Millisecond {
+				t.Fatalf("expected deadline in %v, got %v", tc.timeout, d)
+			}
+		})
+	}
+}
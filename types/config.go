@@ -0,0 +1,364 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package types
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// DecodeStrict decodes YAML (or JSON) document, unknown fields are reported as error,
+// so that typos in configuration don't go unnoticed.
+func DecodeStrict(data []byte, out interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+const (
+	// coordinatePrecision is number of decimal places open-meteo effectively uses for coordinates.
+	coordinatePrecision = 2
+	minForecastDays     = 1
+	maxForecastDays     = 16
+	minElevation        = -500
+	maxElevation        = 9000
+	maxLatitude         = 90
+	maxLongitude        = 180
+)
+
+// Merge appends locations of other config to this one and copies global settings which are set in other.
+// Global setting defined in both configs with different values is reported as conflict.
+func (c *Config) Merge(other *Config) error {
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(other).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if field.Name == "Locations" {
+			c.Locations = append(c.Locations, other.Locations...)
+			continue
+		}
+		sv, dv := src.Field(i), dst.Field(i)
+		if sv.IsZero() {
+			continue
+		}
+		if !dv.IsZero() && !reflect.DeepEqual(dv.Interface(), sv.Interface()) {
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			return fmt.Errorf("conflicting values of %s: %v and %v", name, dv.Interface(), sv.Interface())
+		}
+		dv.Set(sv)
+	}
+	return nil
+}
+
+var (
+	labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// reservedLabels are names of labels used by exporter itself, which static labels can't override
+	reservedLabels = []string{"location", "model", "unit", "height", "depth", "layer",
+		"description", "hour", "day", "timezone", "abbreviation", "latitude", "longitude"}
+)
+
+// ValidLatitude returns true if v is latitude within [-90, 90].
+func ValidLatitude(v float64) bool {
+	return v >= -maxLatitude && v <= maxLatitude
+}
+
+// ValidLongitude returns true if v is longitude within [-180, 180].
+func ValidLongitude(v float64) bool {
+	return v >= -maxLongitude && v <= maxLongitude
+}
+
+func decimalPlaces(v float64) int {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if idx := strings.IndexByte(s, '.'); idx >= 0 {
+		return len(s) - idx - 1
+	}
+	return 0
+}
+
+// duplicateNames returns sorted names used by more than one location.
+// Name is primary label of all series of location, so it must be unique, even if locations differ in model.
+func (c *Config) duplicateNames() []string {
+	seen := map[string]int{}
+	for _, loc := range c.Locations {
+		seen[loc.Name]++
+	}
+	var dups []string
+	for name, n := range seen {
+		if n > 1 {
+			dups = append(dups, name)
+		}
+	}
+	slices.Sort(dups)
+	return dups
+}
+
+// mixedPrecipitationUnits returns true if locations with same static labels use different precipitation units,
+// so that their precipitation series differ only in unit label and aggregating them mixes mm and inch.
+func (c *Config) mixedPrecipitationUnits() bool {
+	units := map[string]string{}
+	for _, loc := range c.Locations {
+		unit := loc.PrecipitationUnit
+		if unit == "" {
+			unit = PrecipitationUnitMm
+		}
+		var pairs []string
+		for k, v := range loc.Labels {
+			pairs = append(pairs, k+"="+v)
+		}
+		slices.Sort(pairs)
+		key := strings.Join(pairs, ",")
+		if u, seen := units[key]; seen && u != unit {
+			return true
+		}
+		units[key] = unit
+	}
+	return false
+}
+
+const redacted = "<redacted>"
+
+// redactURL replaces password in userinfo of URL, URL which can't be parsed is replaced altogether.
+func redactURL(s string) string {
+	if s == "" {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	return u.Redacted()
+}
+
+// Redacted returns copy of configuration with secrets replaced, so that it can be safely shown.
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.APIKey != "" {
+		r.APIKey = redacted
+	}
+	if r.InfluxToken != "" {
+		r.InfluxToken = redacted
+	}
+	r.Proxy = redactURL(r.Proxy)
+	r.BaseURL = redactURL(r.BaseURL)
+	r.InfluxURL = redactURL(r.InfluxURL)
+	if r.Locations != nil {
+		r.Locations = slices.Clone(r.Locations)
+		for i := range r.Locations {
+			r.Locations[i].BaseURL = redactURL(r.Locations[i].BaseURL)
+		}
+	}
+	if r.OTLP != nil {
+		otlp := *r.OTLP
+		otlp.Endpoint = redactURL(otlp.Endpoint)
+		otlp.Headers = make(map[string]string, len(r.OTLP.Headers))
+		for k := range r.OTLP.Headers {
+			otlp.Headers[k] = redacted
+		}
+		r.OTLP = &otlp
+	}
+	return &r
+}
+
+// LoadCAFile returns pool of CA certificates from PEM bundle at path.
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// LabelKeys returns sorted union of keys of static labels of all locations.
+func (c *Config) LabelKeys() []string {
+	var keys []string
+	for _, loc := range c.Locations {
+		for key := range loc.Labels {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+func validateLabelName(name string) error {
+	if !labelNameRe.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	if slices.Contains(reservedLabels, name) {
+		return fmt.Errorf("label name %q is reserved", name)
+	}
+	return nil
+}
+
+// Validate checks configuration for errors. Suspicious, but otherwise usable values are reported as warnings.
+func (c *Config) Validate(logger *slog.Logger) error {
+	switch c.NonFinitePolicy {
+	case "", NonFinitePolicySkip, NonFinitePolicyWarn, NonFinitePolicyKeep:
+	default:
+		return fmt.Errorf("unknown non_finite_policy: %s", c.NonFinitePolicy)
+	}
+	if c.DefaultTtlMinutes < 0 {
+		return fmt.Errorf("default_ttl_minutes can't be negative: %d", c.DefaultTtlMinutes)
+	}
+	if c.MaxConcurrency < 0 {
+		return fmt.Errorf("max_concurrency can't be negative: %d", c.MaxConcurrency)
+	}
+	if c.CAFile != "" {
+		if _, err := LoadCAFile(c.CAFile); err != nil {
+			return fmt.Errorf("invalid ca_file: %w", err)
+		}
+	}
+	if c.InsecureSkipVerify {
+		logger.Warn("TLS certificate verification is disabled (insecure_skip_verify), connections to API are not secure")
+	}
+	if c.RequestsPerMinute < 0 {
+		return fmt.Errorf("requests_per_minute can't be negative: %d", c.RequestsPerMinute)
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("max_retries can't be negative: %d", c.MaxRetries)
+	}
+	if c.Proxy != "" {
+		if _, err := url.Parse(c.Proxy); err != nil {
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+	}
+	if c.OTLP != nil {
+		if c.OTLP.Endpoint == "" {
+			return fmt.Errorf("otlp endpoint is required")
+		}
+		u, err := url.Parse(c.OTLP.Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid otlp endpoint: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("otlp endpoint must be http or https URL: %s", c.OTLP.Endpoint)
+		}
+		if c.OTLP.Interval < 0 {
+			return fmt.Errorf("otlp interval can't be negative: %v", c.OTLP.Interval)
+		}
+	}
+	if c.InfluxURL != "" {
+		if _, err := url.Parse(c.InfluxURL); err != nil {
+			return fmt.Errorf("invalid influx_url: %w", err)
+		}
+		if c.InfluxBucket == "" {
+			return fmt.Errorf("influx_bucket is required when influx_url is set")
+		}
+		if !c.BackgroundRefresh && !slices.ContainsFunc(c.Locations, func(loc Location) bool { return loc.Schedule != "" }) {
+			logger.Warn("influx_url is set, but neither background_refresh nor schedule of any location is, nothing will be pushed")
+		}
+	}
+	if dups := c.duplicateNames(); len(dups) > 0 {
+		return fmt.Errorf("duplicate location names: %s", strings.Join(dups, ", "))
+	}
+	if c.mixedPrecipitationUnits() {
+		logger.Warn("locations mix precipitation units without distinguishing labels, aggregate precipitation series by unit label")
+	}
+	for i := range c.Locations {
+		loc := &c.Locations[i]
+		// missing method means default one
+		if loc.FetchMethod != nil && !loc.FetchMethod.Valid() {
+			return fmt.Errorf("unknown method of location %s: %s", loc.Name, *loc.FetchMethod)
+		}
+		switch loc.TemperatureUnit {
+		case "", TemperatureUnitCelsius, TemperatureUnitFahrenheit:
+		default:
+			return fmt.Errorf("unknown temperature_unit of location %s: %s", loc.Name, loc.TemperatureUnit)
+		}
+		if loc.TimeoutSeconds < 0 {
+			return fmt.Errorf("timeout_seconds of location %s can't be negative: %d", loc.Name, loc.TimeoutSeconds)
+		}
+		if loc.Schedule != "" {
+			if _, err := cron.ParseStandard(loc.Schedule); err != nil {
+				return fmt.Errorf("invalid schedule of location %s: %w", loc.Name, err)
+			}
+		}
+		for key := range loc.Labels {
+			if err := validateLabelName(key); err != nil {
+				return fmt.Errorf("invalid labels of location %s: %w", loc.Name, err)
+			}
+		}
+		if loc.Models != "" && strings.TrimSpace(strings.ReplaceAll(loc.Models, ",", "")) == "" {
+			return fmt.Errorf("invalid models of location %s: %q", loc.Name, loc.Models)
+		}
+		if loc.Elevation != nil && (*loc.Elevation < minElevation || *loc.Elevation > maxElevation) {
+			return fmt.Errorf("elevation of location %s out of range [%d, %d]: %v",
+				loc.Name, minElevation, maxElevation, *loc.Elevation)
+		}
+		if loc.Timezone != "" && loc.Timezone != TimezoneAuto {
+			if strings.TrimSpace(loc.Timezone) != loc.Timezone {
+				return fmt.Errorf("invalid timezone of location %s: %q", loc.Name, loc.Timezone)
+			}
+			// tzdata might be missing on host, so unknown timezone is not fatal, API validates it anyway
+			if _, err := time.LoadLocation(loc.Timezone); err != nil {
+				logger.Warn("Unknown timezone, API might reject it", "location", loc.Name, "timezone", loc.Timezone)
+			}
+		}
+		switch loc.PrecipitationUnit {
+		case "", PrecipitationUnitMm, PrecipitationUnitInch:
+		default:
+			return fmt.Errorf("unknown precipitation_unit of location %s: %s", loc.Name, loc.PrecipitationUnit)
+		}
+		switch loc.WindSpeedUnit {
+		case "", WindSpeedUnitKmh, WindSpeedUnitMs, WindSpeedUnitMph, WindSpeedUnitKn:
+		default:
+			return fmt.Errorf("unknown wind_speed_unit of location %s: %s", loc.Name, loc.WindSpeedUnit)
+		}
+		if loc.ForecastDays != 0 && (loc.ForecastDays < minForecastDays || loc.ForecastDays > maxForecastDays) {
+			clamped := max(minForecastDays, min(maxForecastDays, loc.ForecastDays))
+			logger.Warn("Number of forecast days out of range, clamping",
+				"location", loc.Name, "forecast_days", loc.ForecastDays, "clamped", clamped)
+			loc.ForecastDays = clamped
+		}
+		if !ValidLatitude(loc.Latitude) {
+			return fmt.Errorf("latitude of location %s out of range [-90, 90]: %v", loc.Name, loc.Latitude)
+		}
+		if !ValidLongitude(loc.Longitude) {
+			return fmt.Errorf("longitude of location %s out of range [-180, 180]: %v", loc.Name, loc.Longitude)
+		}
+		if decimalPlaces(loc.Latitude) > coordinatePrecision || decimalPlaces(loc.Longitude) > coordinatePrecision {
+			logger.Warn("Coordinates have more decimal places than API resolves, they will be rounded",
+				"location", loc.Name,
+				"latitude", strconv.FormatFloat(loc.Latitude, 'f', coordinatePrecision, 64),
+				"longitude", strconv.FormatFloat(loc.Longitude, 'f', coordinatePrecision, 64))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package types
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestDecodeStrictRejectsUnknownKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{name: "known keys", doc: "max_retries: 2\nlocations:\n  - name: Home\n    latitude: 48.14\n"},
+		{name: "empty document", doc: ""},
+		{name: "unknown top-level key", doc: "max_retires: 2\n", wantErr: "field max_retires not found"},
+		{name: "unknown key of location", doc: "locations:\n  - name: Home\n    lattitude: 48.14\n", wantErr: "field lattitude not found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg Config
+			err := DecodeStrict([]byte(tc.doc), &cfg)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsDuplicateNames(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		locations []Location
+		wantErr   string
+	}{
+		{
+			name:      "unique",
+			locations: []Location{{Name: "Bratislava"}, {Name: "Vienna"}},
+		},
+		{
+			name:      "same name",
+			locations: []Location{{Name: "Bratislava"}, {Name: "Bratislava"}},
+			wantErr:   "duplicate location names: Bratislava",
+		},
+		{
+			name: "same name with different models",
+			locations: []Location{
+				{Name: "Bratislava", Models: "icon_seamless"},
+				{Name: "Bratislava", Models: "gfs_seamless"},
+			},
+			wantErr: "duplicate location names: Bratislava",
+		},
+		{
+			name: "same coordinates with different names",
+			locations: []Location{
+				{Name: "Bratislava (icon)", Models: "icon_seamless", Coordinates: Coordinates{Latitude: 48.14, Longitude: 17.1}},
+				{Name: "Bratislava (gfs)", Models: "gfs_seamless", Coordinates: Coordinates{Latitude: 48.14, Longitude: 17.1}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := (&Config{Locations: tc.locations}).Validate(discardLogger)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		schedule string
+		wantErr  string
+	}{
+		{name: "no schedule"},
+		{name: "valid", schedule: "*/15 6-22 * * *"},
+		{name: "descriptor", schedule: "@hourly"},
+		{name: "too few fields", schedule: "*/15 * *", wantErr: "invalid schedule of location Bratislava"},
+		{name: "out of range", schedule: "0 25 * * *", wantErr: "invalid schedule of location Bratislava"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := (&Config{Locations: []Location{{Name: "Bratislava", Schedule: tc.schedule}}}).Validate(discardLogger)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateWarnsAboutMixedPrecipitationUnits(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		locations   []Location
+		wantWarning bool
+	}{
+		{
+			name:      "same unit",
+			locations: []Location{{Name: "Bratislava"}, {Name: "Vienna", PrecipitationUnit: PrecipitationUnitMm}},
+		},
+		{
+			name:        "mixed units",
+			locations:   []Location{{Name: "Bratislava"}, {Name: "New York", PrecipitationUnit: PrecipitationUnitInch}},
+			wantWarning: true,
+		},
+		{
+			name: "mixed units with same labels",
+			locations: []Location{
+				{Name: "Bratislava", Labels: map[string]string{"site": "office"}},
+				{Name: "New York", PrecipitationUnit: PrecipitationUnitInch, Labels: map[string]string{"site": "office"}},
+			},
+			wantWarning: true,
+		},
+		{
+			name: "mixed units with distinguishing labels",
+			locations: []Location{
+				{Name: "Bratislava", Labels: map[string]string{"region": "eu"}},
+				{Name: "New York", PrecipitationUnit: PrecipitationUnitInch, Labels: map[string]string{"region": "us"}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			cfg := &Config{Locations: tc.locations}
+			if err := cfg.Validate(slog.New(slog.NewTextHandler(&out, nil))); err != nil {
+				t.Fatal(err)
+			}
+			warned := strings.Contains(out.String(), "mix precipitation units")
+			if warned != tc.wantWarning {
+				t.Fatalf("expected warning: %v, log: %s", tc.wantWarning, out.String())
+			}
+		})
+	}
+}
+
+func TestValidateRejectsCoordinatesOutOfRange(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		coordinates Coordinates
+		wantErr     string
+	}{
+		{name: "valid", coordinates: Coordinates{Latitude: 48.14, Longitude: 17.1}},
+		{name: "bounds", coordinates: Coordinates{Latitude: -90, Longitude: 180}},
+		{name: "latitude too high", coordinates: Coordinates{Latitude: 123, Longitude: 17.1}, wantErr: "latitude of location Home out of range"},
+		{name: "latitude too low", coordinates: Coordinates{Latitude: -90.5, Longitude: 17.1}, wantErr: "latitude of location Home out of range"},
+		{name: "longitude too low", coordinates: Coordinates{Latitude: 48.14, Longitude: -500}, wantErr: "longitude of location Home out of range"},
+		{name: "longitude too high", coordinates: Coordinates{Latitude: 48.14, Longitude: 180.01}, wantErr: "longitude of location Home out of range"},
+		{name: "latitude NaN", coordinates: Coordinates{Latitude: math.NaN(), Longitude: 17.1}, wantErr: "latitude of location Home out of range"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := (&Config{Locations: []Location{{Name: "Home", Coordinates: tc.coordinates}}}).Validate(discardLogger)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateWarnsAboutCoordinatePrecision(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		coordinates Coordinates
+		wantWarning bool
+	}{
+		{name: "two decimal places", coordinates: Coordinates{Latitude: 48.14, Longitude: 17.1}},
+		{name: "integers", coordinates: Coordinates{Latitude: 48, Longitude: -17}},
+		{name: "precise latitude", coordinates: Coordinates{Latitude: 48.2082, Longitude: 16.37}, wantWarning: true},
+		{name: "precise longitude", coordinates: Coordinates{Latitude: 48.21, Longitude: 16.3738}, wantWarning: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			cfg := &Config{Locations: []Location{{Name: "Vienna", Coordinates: tc.coordinates}}}
+			if err := cfg.Validate(slog.New(slog.NewTextHandler(&out, nil))); err != nil {
+				t.Fatal(err)
+			}
+			warned := strings.Contains(out.String(), "more decimal places than API resolves")
+			if warned != tc.wantWarning {
+				t.Fatalf("expected warning: %v, log: %s", tc.wantWarning, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2024 Richard Kosegi
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package types
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestNumberUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		input   string
+		want    Number
+		wantErr bool
+	}{
+		{input: `12.3`, want: 12.3},
+		{input: `"12.3"`, want: 12.3},
+		{input: `" -4.5 "`, want: -4.5},
+		{input: `"1e3"`, want: 1000},
+		{input: `"12,3"`, wantErr: true},
+		{input: `"abc"`, wantErr: true},
+		{input: `""`, wantErr: true},
+		{input: `true`, wantErr: true},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			var n Number
+			err := json.Unmarshal([]byte(tc.input), &n)
+			switch {
+			case tc.wantErr && err == nil:
+				t.Fatalf("expected error, got %v", n)
+			case !tc.wantErr && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case n != tc.want:
+				t.Fatalf("expected %v, got %v", tc.want, n)
+			}
+		})
+	}
+}
+
+func TestResponseAltWithStringNumbers(t *testing.T) {
+	var resp ResponseAlt
+	data := `{"current": {"temperature_2m": "3.5", "wind_speed_10m": 12.0, "uv_index": null}}`
+	if err := json.Unmarshal([]byte(data), &resp); err != nil {
+		t.Fatal(err)
+	}
+	cw := resp.CurrentWeather
+	if cw.Temperature == nil || *cw.Temperature != 3.5 || cw.WindSpeed == nil || *cw.WindSpeed != 12 || cw.UvIndex != nil {
+		t.Fatalf("unexpected current weather: %+v", cw)
+	}
+	if err := json.Unmarshal([]byte(`{"current": {"temperature_2m": "warm"}}`), &resp); err == nil {
+		t.Fatal("expected malformed number to be rejected")
+	}
+}
+
+func TestNumberMarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		input Number
+		want  string
+	}{
+		{input: 12.5, want: `12.5`},
+		{input: Number(math.NaN()), want: `null`},
+		{input: Number(math.Inf(-1)), want: `null`},
+	} {
+		data, err := json.Marshal(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.want {
+			t.Errorf("expected %s, got %s", tc.want, data)
+		}
+	}
+}
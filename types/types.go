@@ -17,29 +17,60 @@
 
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type CurrentWeatherDefault struct {
-	Temperature   float64
+	// Time of observation in ISO8601 format, without timezone
+	Time          string  `json:"time"`
+	Temperature   float64 `json:"temperature"`
 	WindSpeed     float64 `json:"windspeed"`
 	WindDirection float64 `json:"winddirection"`
 }
 
 type CurrentWeatherAlt struct {
-	Temperature         *float64 `json:"temperature_2m"`
-	ApparentTemperature *float64 `json:"apparent_temperature"`
-	RelativeHumidity    *float64 `json:"relative_humidity_2m"`
-	Precipitation       *float64 `json:"precipitation"`
-	Rain                *float64 `json:"rain"`
-	Showers             *float64 `json:"showers"`
-	Snowfall            *float64 `json:"snowfall"`
-	CloudCover          *float64 `json:"cloud_cover"`
-	SurfacePressure     *float64 `json:"surface_pressure"`
-	PressureMsl         *float64 `json:"pressure_msl"`
-	WindSpeed           *float64 `json:"wind_speed_10m"`
-	WindDirection       *float64 `json:"wind_direction_10m"`
-	WindGusts           *float64 `json:"wind_gusts_10m"`
-	WeatherCode         *float64 `json:"weather_code"`
+	// Time of observation in ISO8601 format, without timezone
+	Time                 string  `json:"time"`
+	Temperature          *Number `json:"temperature_2m"`
+	ApparentTemperature  *Number `json:"apparent_temperature"`
+	RelativeHumidity     *Number `json:"relative_humidity_2m"`
+	Precipitation        *Number `json:"precipitation"`
+	Rain                 *Number `json:"rain"`
+	Showers              *Number `json:"showers"`
+	Snowfall             *Number `json:"snowfall"`
+	CloudCover           *Number `json:"cloud_cover"`
+	SurfacePressure      *Number `json:"surface_pressure"`
+	PressureMsl          *Number `json:"pressure_msl"`
+	WindSpeed            *Number `json:"wind_speed_10m"`
+	WindDirection        *Number `json:"wind_direction_10m"`
+	WindSpeed80m         *Number `json:"wind_speed_80m"`
+	WindSpeed120m        *Number `json:"wind_speed_120m"`
+	WindSpeed180m        *Number `json:"wind_speed_180m"`
+	WindDirection80m     *Number `json:"wind_direction_80m"`
+	WindDirection120m    *Number `json:"wind_direction_120m"`
+	WindDirection180m    *Number `json:"wind_direction_180m"`
+	WindGusts            *Number `json:"wind_gusts_10m"`
+	UvIndex              *Number `json:"uv_index"`
+	Visibility           *Number `json:"visibility"`
+	DewPoint             *Number `json:"dew_point_2m"`
+	IsDay                *Number `json:"is_day"`
+	WeatherCode          *Number `json:"weather_code"`
+	CloudCoverLow        *Number `json:"cloud_cover_low"`
+	CloudCoverMid        *Number `json:"cloud_cover_mid"`
+	CloudCoverHigh       *Number `json:"cloud_cover_high"`
+	SoilTemperature0cm   *Number `json:"soil_temperature_0cm"`
+	SoilTemperature6cm   *Number `json:"soil_temperature_6cm"`
+	SoilTemperature18cm  *Number `json:"soil_temperature_18cm"`
+	SoilTemperature54cm  *Number `json:"soil_temperature_54cm"`
+	SoilMoisture0To1cm   *Number `json:"soil_moisture_0_to_1cm"`
+	SoilMoisture1To3cm   *Number `json:"soil_moisture_1_to_3cm"`
+	SoilMoisture3To9cm   *Number `json:"soil_moisture_3_to_9cm"`
+	SoilMoisture9To27cm  *Number `json:"soil_moisture_9_to_27cm"`
+	SoilMoisture27To81cm *Number `json:"soil_moisture_27_to_81cm"`
+	Evapotranspiration   *Number `json:"et0_fao_evapotranspiration"`
+	VaporPressureDeficit *Number `json:"vapour_pressure_deficit"`
 }
 
 type Coordinates struct {
@@ -50,32 +81,283 @@ type Coordinates struct {
 type FetchMethod string
 
 const (
-	FetchMethodDefault = "default"
-	FetchMethodAlt     = "alt"
+	FetchMethodDefault    = "default"
+	FetchMethodAlt        = "alt"
+	FetchMethodDaily      = "daily"
+	FetchMethodHourly     = "hourly"
+	FetchMethodAirQuality = "air_quality"
+	FetchMethodMarine     = "marine"
+	FetchMethodFlood      = "flood"
+)
+
+const (
+	TemperatureUnitCelsius    = "celsius"
+	TemperatureUnitFahrenheit = "fahrenheit"
+)
+
+const (
+	PrecipitationUnitMm   = "mm"
+	PrecipitationUnitInch = "inch"
+)
+
+const (
+	WindSpeedUnitKmh = "kmh"
+	WindSpeedUnitMs  = "ms"
+	WindSpeedUnitMph = "mph"
+	WindSpeedUnitKn  = "kn"
+)
+
+// TimezoneAuto lets API resolve timezone from coordinates of location
+const TimezoneAuto = "auto"
+
+// Valid returns true if m is one of known fetch methods.
+func (m FetchMethod) Valid() bool {
+	switch m {
+	case FetchMethodDefault, FetchMethodAlt, FetchMethodDaily, FetchMethodHourly,
+		FetchMethodAirQuality, FetchMethodMarine, FetchMethodFlood:
+		return true
+	}
+	return false
+}
+
+type NonFinitePolicy string
+
+const (
+	// NonFinitePolicySkip silently skips NaN and Inf values, this is default
+	NonFinitePolicySkip = "skip"
+	// NonFinitePolicyWarn skips NaN and Inf values and logs warning
+	NonFinitePolicyWarn = "warn"
+	// NonFinitePolicyKeep sets NaN and Inf values to metrics as they are
+	NonFinitePolicyKeep = "keep"
 )
 
+// Range is interval of plausible values of metric, either bound is optional.
+type Range struct {
+	Min *float64 `yaml:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty"`
+	// Drop causes implausible values to be dropped rather than just flagged
+	Drop bool `yaml:"drop,omitempty"`
+}
+
+func (r Range) Contains(v float64) bool {
+	return (r.Min == nil || v >= *r.Min) && (r.Max == nil || v <= *r.Max)
+}
+
 type Location struct {
 	Name        string
 	FetchMethod *FetchMethod `yaml:"method,omitempty"`
 	TtlMinutes  int
+	// Disabled location is not scraped
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Schedule is optional cron expression, when set location is refreshed in background
+	// on every tick instead of on scrape after TTL expires.
+	Schedule string `yaml:"schedule,omitempty"`
+	// ForecastHours is number of hours ahead to export when using hourly method
+	ForecastHours int `yaml:"forecast_hours,omitempty"`
+	// ForecastDays is number of days of forecast to request and export when using daily or flood method.
+	// With hourly method, it limits period of forecast, which ForecastHours narrows further.
+	ForecastDays int `yaml:"forecast_days,omitempty"`
+	// Ranges maps metric name (such as "temperature") to range of plausible values
+	Ranges map[string]Range `yaml:"ranges,omitempty"`
+	// TemperatureUnit is either celsius (default) or fahrenheit
+	TemperatureUnit string `yaml:"temperature_unit,omitempty"`
+	// PrecipitationUnit is either mm (default) or inch
+	PrecipitationUnit string `yaml:"precipitation_unit,omitempty"`
+	// WindSpeedUnit is one of kmh (default), ms, mph or kn
+	WindSpeedUnit string `yaml:"wind_speed_unit,omitempty"`
+	// Timezone is IANA name of timezone used for daily and hourly forecasts, defaults to auto
+	Timezone string `yaml:"timezone,omitempty"`
+	// Elevation overrides elevation API derives from digital elevation model, in meters
+	Elevation *float64 `yaml:"elevation,omitempty"`
+	// Models is comma-separated list of weather models to use, such as icon_seamless. API picks best match when not set.
+	Models string `yaml:"models,omitempty"`
+	// BaseURL overrides endpoint of forecast API for this location
+	BaseURL string `yaml:"base_url,omitempty"`
+	// TimeoutSeconds limits duration of fetch of location including retries. When not set, fetch may take
+	// as long as all attempts allowed by max_retries, each limited by --http.timeout. Every single attempt
+	// is limited by --http.timeout regardless, so value above it only leaves more room for retries.
+	TimeoutSeconds int `yaml:"timeout_seconds,omitempty"`
+	// Labels are static labels attached to every weather metric of location
+	Labels      map[string]string `yaml:"labels,omitempty"`
 	Coordinates `yaml:",inline"`
 }
 
+// TimezoneInfo is timezone in which API reports times.
+type TimezoneInfo struct {
+	Timezone             string `json:"timezone"`
+	TimezoneAbbreviation string `json:"timezone_abbreviation"`
+	UtcOffsetSeconds     *int   `json:"utc_offset_seconds"`
+}
+
+// GenerationInfo is time API spent on generating response.
+type GenerationInfo struct {
+	GenerationTimeMs *float64 `json:"generationtime_ms"`
+}
+
 type Response struct {
 	Coordinates    `json:",inline"`
+	TimezoneInfo   `json:",inline"`
+	GenerationInfo `json:",inline"`
+	Elevation      *float64              `json:"elevation"`
 	CurrentWeather CurrentWeatherDefault `json:"current_weather"`
 }
 
 type ResponseAlt struct {
 	Coordinates    `json:",inline"`
+	TimezoneInfo   `json:",inline"`
+	GenerationInfo `json:",inline"`
+	Elevation      *float64          `json:"elevation"`
 	CurrentWeather CurrentWeatherAlt `json:"current"`
 }
 
+// DailyForecast holds daily aggregations, values at the same index belong to the same day in Time.
+type DailyForecast struct {
+	Time           []string  `json:"time"`
+	TemperatureMax []*Number `json:"temperature_2m_max"`
+	TemperatureMin []*Number `json:"temperature_2m_min"`
+}
+
+type ResponseDaily struct {
+	Coordinates    `json:",inline"`
+	TimezoneInfo   `json:",inline"`
+	GenerationInfo `json:",inline"`
+	Elevation      *float64      `json:"elevation"`
+	Daily          DailyForecast `json:"daily"`
+}
+
+// HourlyForecast holds hourly values, values at the same index belong to the same hour in Time.
+type HourlyForecast struct {
+	Time                     []string  `json:"time"`
+	Temperature              []*Number `json:"temperature_2m"`
+	PrecipitationProbability []*Number `json:"precipitation_probability"`
+}
+
+type ResponseHourly struct {
+	Coordinates    `json:",inline"`
+	TimezoneInfo   `json:",inline"`
+	GenerationInfo `json:",inline"`
+	Elevation      *float64       `json:"elevation"`
+	Hourly         HourlyForecast `json:"hourly"`
+}
+
+type CurrentAirQuality struct {
+	EuropeanAqi *Number `json:"european_aqi"`
+	UsAqi       *Number `json:"us_aqi"`
+}
+
+type ResponseAirQuality struct {
+	Coordinates    `json:",inline"`
+	TimezoneInfo   `json:",inline"`
+	GenerationInfo `json:",inline"`
+	Current        CurrentAirQuality `json:"current"`
+}
+
+type CurrentMarine struct {
+	WaveHeight      *Number `json:"wave_height"`
+	WaveDirection   *Number `json:"wave_direction"`
+	WavePeriod      *Number `json:"wave_period"`
+	SwellWaveHeight *Number `json:"swell_wave_height"`
+	SwellWavePeriod *Number `json:"swell_wave_period"`
+}
+
+type MarineResponse struct {
+	Coordinates    `json:",inline"`
+	TimezoneInfo   `json:",inline"`
+	GenerationInfo `json:",inline"`
+	Current        CurrentMarine `json:"current"`
+}
+
+type DailyFlood struct {
+	Time           []string  `json:"time"`
+	RiverDischarge []*Number `json:"river_discharge"`
+}
+
+type FloodResponse struct {
+	Coordinates    `json:",inline"`
+	TimezoneInfo   `json:",inline"`
+	GenerationInfo `json:",inline"`
+	Daily          DailyFlood `json:"daily"`
+}
+
+// APIError is body of API response with status other than 2xx.
+type APIError struct {
+	Error  bool   `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// BatchResponse is response to request for multiple coordinates, every item is response of single location.
+type BatchResponse []json.RawMessage
+
 type CacheEntry struct {
 	Response   interface{}
 	LastUpdate time.Time
+	// ETag and LastModified are validators of response, sent with next request to API to make it conditional
+	ETag         string
+	LastModified string
+}
+
+// OTLPConfig is configuration of push of weather metrics using OTLP/gRPC.
+type OTLPConfig struct {
+	// Endpoint is URL of OTLP/gRPC receiver, such as http://collector:4317. Scheme https enables TLS.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are sent with every request, e.g. for authentication
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Interval between pushes, each of which carries metrics of all locations. Defaults to 1m.
+	Interval time.Duration `yaml:"interval,omitempty"`
 }
 
 type Config struct {
 	Locations []Location
+	// LocationsFile is path of YAML or JSON file with additional locations, which is watched for changes
+	LocationsFile string `yaml:"locations_file,omitempty"`
+	// CacheKeyPrefix is prepended to every cache key. It's reserved for cache store shared by multiple instances,
+	// in-memory cache is private to each instance
+	CacheKeyPrefix string `yaml:"cache_key_prefix,omitempty"`
+	// NonFinitePolicy controls how NaN and Inf values received from API are handled
+	NonFinitePolicy NonFinitePolicy `yaml:"non_finite_policy,omitempty"`
+	// DropStaleSeries enables immediate deletion of series of disabled or persistently failing locations,
+	// instead of on expiry of their cached data
+	DropStaleSeries bool `yaml:"drop_stale_series,omitempty"`
+	// StaleAfterFailures is number of consecutive failures after which location is considered persistently failing
+	StaleAfterFailures int `yaml:"stale_after_failures,omitempty"`
+	// BaseURL is endpoint of forecast API, such as self-hosted instance. Public API is used when not set.
+	BaseURL string `yaml:"base_url,omitempty"`
+	// DefaultTtlMinutes is TTL of locations which don't set their own, defaults to 10 minutes
+	DefaultTtlMinutes int `yaml:"default_ttl_minutes,omitempty"`
+	// MaxConcurrency is maximum number of locations scraped concurrently
+	MaxConcurrency int `yaml:"max_concurrency,omitempty"`
+	// Batch enables fetching of locations which differ only in coordinates in single request
+	Batch bool `yaml:"batch,omitempty"`
+	// BackgroundRefresh enables refreshing of locations in background every TTL, so that scrapes are served from cache
+	BackgroundRefresh bool `yaml:"background_refresh,omitempty"`
+	// CachePath is path of file to which cache is saved on shutdown and loaded from on start. Disabled when empty.
+	CachePath string `yaml:"cache_path,omitempty"`
+	// CacheCompress enables gzip compression of cache file
+	CacheCompress bool `yaml:"cache_compress,omitempty"`
+	// MaxRetries is number of times failed request is retried, only network errors and 5xx responses are retried
+	MaxRetries int `yaml:"max_retries,omitempty"`
+	// RetryBackoff is base delay before retry, which doubles with every attempt. Defaults to 1s.
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+	// Proxy is URL of HTTP proxy, overrides HTTP_PROXY and HTTPS_PROXY environment variables
+	Proxy string `yaml:"proxy,omitempty"`
+	// UserAgent overrides User-Agent header sent to API
+	UserAgent string `yaml:"user_agent,omitempty"`
+	// APIKey of commercial API, environment variables are expanded. When set, customer endpoints are used.
+	APIKey string `yaml:"api_key,omitempty"`
+	// RequestsPerMinute limits rate of requests to API, requests above limit wait for their turn. Unlimited when not set.
+	RequestsPerMinute int `yaml:"requests_per_minute,omitempty"`
+	// CAFile is path of PEM bundle of CA certificates used to verify API server, e.g. self-hosted instance with private CA
+	CAFile string `yaml:"ca_file,omitempty"`
+	// InsecureSkipVerify disables verification of API server certificate, use only for testing
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+	// InfluxURL is base URL of InfluxDB v2, current weather is pushed there on every background or scheduled refresh
+	InfluxURL string `yaml:"influx_url,omitempty"`
+	// InfluxOrg is organization of InfluxDB bucket
+	InfluxOrg string `yaml:"influx_org,omitempty"`
+	// InfluxBucket is bucket data are written to
+	InfluxBucket string `yaml:"influx_bucket,omitempty"`
+	// InfluxToken is API token used to authenticate to InfluxDB
+	InfluxToken string `yaml:"influx_token,omitempty"`
+	// OTLP enables periodic push of weather metrics of all locations to OpenTelemetry collector
+	OTLP *OTLPConfig `yaml:"otlp,omitempty"`
 }